@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"gopkg.in/telegram-bot-api.v4"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// redditURL is prepended to reddit permalinks (which are relative).
+const redditURL = "https://www.reddit.com"
+
+// auditRecord is one entry in the audit log: a post sent by the bot. The
+// post was sent to ChatID, in response to MessageID from UserID in
+// TriggerChatID (which differs from ChatID for rules publishing to a
+// channel).
+type auditRecord struct {
+	Time          time.Time `json:"time"`
+	ChatID        int64     `json:"chat_id"`
+	TriggerChatID int64     `json:"trigger_chat_id"`
+	UserID        int       `json:"user_id"`
+	MessageID     int       `json:"message_id"`
+	SentID        int       `json:"sent_message_id"`
+	Rule          string    `json:"rule"`
+	Source        string    `json:"source"`
+	Target        string    `json:"target"`
+	Subreddit     string    `json:"subreddit,omitempty"`
+	PostID        string    `json:"post_id,omitempty"`
+	Permalink     string    `json:"permalink,omitempty"`
+	MediaURL      string    `json:"media_url"`
+	MediaType     string    `json:"media_type"`
+}
+
+// auditLog is an append-only log of auditRecords, one JSON object per line.
+type auditLog struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+// audit holds the bot's audit log. Nil disables auditing.
+var audit *auditLog
+
+// openAuditLog opens (or creates) the audit log file for appending.
+func openAuditLog(fname string) (*auditLog, error) {
+	if err := os.MkdirAll(filepath.Dir(fname), 0700); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(fname, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("error opening audit log: %v", err)
+	}
+	return &auditLog{f: f}, nil
+}
+
+// newAuditRecord returns an audit record for post, sent to chatID as sentMsg
+// in response to trig, matching rule.
+func newAuditRecord(chatID int64, trig postTrigger, sentMsg *tgbotapi.Message, rule TriggerRule, post mediaPost) auditRecord {
+	permalink := post.Permalink
+	if strings.HasPrefix(permalink, "/") {
+		permalink = redditURL + permalink
+	}
+	return auditRecord{
+		Time:          time.Now().UTC(),
+		ChatID:        chatID,
+		TriggerChatID: trig.chatID,
+		UserID:        trig.userID,
+		MessageID:     trig.messageID,
+		SentID:        sentMsg.MessageID,
+		Rule:          rule.name,
+		Source:        rule.source,
+		Target:        rule.target,
+		Subreddit:     post.Subreddit,
+		PostID:        post.ID,
+		Permalink:     permalink,
+		MediaURL:      post.MediaURL,
+		MediaType:     mediaTypeName(post.MediaType),
+	}
+}
+
+// write appends rec to the audit log. Writing to a nil log is a no-op.
+func (a *auditLog) write(rec auditRecord) error {
+	if a == nil {
+		return nil
+	}
+	buf, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	_, err = a.f.Write(append(buf, '\n'))
+	return err
+}
+
+// auditQuery selects records from the audit log.
+type auditQuery struct {
+	chatID int64 // Posts in or triggered from the chat. Zero matches all chats.
+	since  time.Time
+	until  time.Time
+}
+
+// match returns true if rec matches the query.
+func (q auditQuery) match(rec auditRecord) bool {
+	if q.chatID != 0 && rec.ChatID != q.chatID && rec.TriggerChatID != q.chatID {
+		return false
+	}
+	if !q.since.IsZero() && rec.Time.Before(q.since) {
+		return false
+	}
+	if !q.until.IsZero() && !rec.Time.Before(q.until) {
+		return false
+	}
+	return true
+}
+
+// queryAudit reads audit records from r and writes the ones matching q to w,
+// as JSON lines.
+func queryAudit(r io.Reader, w io.Writer, q auditQuery) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		var rec auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return fmt.Errorf("audit log line %d: %v", line, err)
+		}
+		if !q.match(rec) {
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "%s\n", scanner.Bytes()); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// parseAuditTime parses a time in RFC3339 format, a date (YYYY-MM-DD, local
+// time) or a duration, meaning that long ago (e.g. "24h").
+func parseAuditTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t, nil
+	}
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(-d), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time: %q (use RFC3339, YYYY-MM-DD or a duration)", s)
+}
+
+// runAudit implements the "audit" subcommand, printing the audit log records
+// matching the command line flags in args.
+func runAudit(config botConfig, args []string) error {
+	fs := flag.NewFlagSet("audit", flag.ContinueOnError)
+	chatID := fs.Int64("chat", 0, "Only show posts in (or triggered from) this chat ID.")
+	since := fs.String("since", "", "Only show posts at or after this time (RFC3339, YYYY-MM-DD or a duration like 24h).")
+	until := fs.String("until", "", "Only show posts before this time (RFC3339, YYYY-MM-DD or a duration like 1h).")
+	if err := fs.Parse(args); err != nil {
+		if err == flag.ErrHelp {
+			return nil
+		}
+		return err
+	}
+
+	q := auditQuery{chatID: *chatID}
+	var err error
+	if *since != "" {
+		if q.since, err = parseAuditTime(*since); err != nil {
+			return err
+		}
+	}
+	if *until != "" {
+		if q.until, err = parseAuditTime(*until); err != nil {
+			return err
+		}
+	}
+
+	f, err := os.Open(config.AuditLog)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return queryAudit(f, os.Stdout, q)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/marcopaganini/pixiebot/reddit"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+const (
+	// Scope requested from reddit in the authorization code flow. We only
+	// need to read listings.
+	authorizeScope = "read"
+)
+
+// authorizeResult holds the outcome of the authorization redirect.
+type authorizeResult struct {
+	code string
+	err  error
+}
+
+// redditAuthorize runs reddit's authorization code flow: it prints the
+// authorization URL for the user to visit, waits for reddit to redirect the
+// browser to a local listener on the configured redirect URI, exchanges the
+// code for a refresh token and saves it to the state directory. The bot uses
+// the refresh_token grant after that.
+func redditAuthorize(config botConfig) error {
+	if config.ClientID == "" {
+		return errors.New("client_id cannot be null")
+	}
+	redirect, err := url.Parse(config.RedirectURI)
+	if err != nil {
+		return fmt.Errorf("invalid redirect_uri: %v", err)
+	}
+	if redirect.Scheme != "http" {
+		return fmt.Errorf("redirect_uri must use http on a local address, got: %s", config.RedirectURI)
+	}
+	// Reddit accepts redirect URIs without a path (the browser requests "/").
+	callbackPath := redirect.Path
+	if callbackPath == "" {
+		callbackPath = "/"
+	}
+
+	state, err := randomState()
+	if err != nil {
+		return err
+	}
+
+	ch := make(chan authorizeResult, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc(callbackPath, func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		var res authorizeResult
+		switch {
+		case q.Get("state") != state:
+			res.err = errors.New("state mismatch in authorization response")
+		case q.Get("error") != "":
+			res.err = fmt.Errorf("authorization denied: %s", q.Get("error"))
+		case q.Get("code") == "":
+			res.err = errors.New("no code in authorization response")
+		default:
+			res.code = q.Get("code")
+		}
+		if res.err != nil {
+			http.Error(w, res.err.Error(), http.StatusBadRequest)
+		} else {
+			fmt.Fprintln(w, "Authorization complete. You can close this window.")
+		}
+		select {
+		case ch <- res:
+		default:
+		}
+	})
+
+	ln, err := net.Listen("tcp", redirect.Host)
+	if err != nil {
+		return fmt.Errorf("unable to listen on %s: %v", redirect.Host, err)
+	}
+	srv := &http.Server{Handler: mux}
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	fmt.Printf("Visit the following URL in your browser to authorize pixiebot:\n\n%s\n\n",
+		reddit.AuthorizeURL(config.ClientID, config.RedirectURI, state, authorizeScope))
+	fmt.Printf("Waiting for the authorization redirect on %s...\n", config.RedirectURI)
+
+	res := <-ch
+	if res.err != nil {
+		return res.err
+	}
+
+	cred := reddit.NewCredentials("", "", config.ClientID, config.Secret)
+	tok, err := cred.ExchangeCode(res.code, config.RedirectURI)
+	if err != nil {
+		return err
+	}
+	f, err := saveRefreshToken(tok)
+	if err != nil {
+		return fmt.Errorf("error saving refresh token: %v", err)
+	}
+	slog.Info("Refresh token saved", "file", f)
+	return nil
+}
+
+// randomState returns a random string used as the "state" parameter in the
+// authorization code flow.
+func randomState() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
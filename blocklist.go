@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// chatBlocklist holds the posts and subreddits (or source targets) blocked
+// in one chat.
+type chatBlocklist struct {
+	Posts      map[string]bool `json:"posts,omitempty"`
+	Subreddits map[string]bool `json:"subreddits,omitempty"`
+}
+
+// blockList holds the per-chat blocklists. Changes are saved to a file
+// immediately.
+type blockList struct {
+	mu    sync.Mutex
+	fname string
+	chats map[int64]*chatBlocklist
+}
+
+// blocklist holds the bot's blocklist. Nil disables blocking.
+var blocklist *blockList
+
+// loadBlocklist reads the blocklist from the state directory. A missing file
+// yields an empty blocklist.
+func loadBlocklist() (*blockList, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	b := &blockList{fname: filepath.Join(dir, blocklistFile), chats: map[int64]*chatBlocklist{}}
+	buf, err := ioutil.ReadFile(b.fname)
+	if os.IsNotExist(err) {
+		return b, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &b.chats); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// save writes the blocklist to its file. Must be called with b.mu held.
+func (b *blockList) save() error {
+	buf, err := json.MarshalIndent(b.chats, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(b.fname), 0700); err != nil {
+		return err
+	}
+	// Write to a temporary file and rename, so a crash never leaves a
+	// truncated blocklist behind.
+	tmp := b.fname + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, b.fname)
+}
+
+// chat returns the blocklist for chatID, creating it if needed. Must be
+// called with b.mu held.
+func (b *blockList) chat(chatID int64) *chatBlocklist {
+	c, ok := b.chats[chatID]
+	if !ok {
+		c = &chatBlocklist{}
+		b.chats[chatID] = c
+	}
+	if c.Posts == nil {
+		c.Posts = map[string]bool{}
+	}
+	if c.Subreddits == nil {
+		c.Subreddits = map[string]bool{}
+	}
+	return c
+}
+
+// blockPost blocks the post ID in chatID.
+func (b *blockList) blockPost(chatID int64, postID string) error {
+	if b == nil || postID == "" {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.chat(chatID).Posts[postID] = true
+	return b.save()
+}
+
+// blockSubreddit blocks the subreddit (or source target) in chatID.
+func (b *blockList) blockSubreddit(chatID int64, subreddit string) error {
+	if b == nil || subreddit == "" {
+		return nil
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.chat(chatID).Subreddits[strings.ToLower(subreddit)] = true
+	return b.save()
+}
+
+// subredditBlocked returns true if the subreddit (or source target) is
+// blocked in chatID.
+func (b *blockList) subredditBlocked(chatID int64, subreddit string) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.chats[chatID]
+	return ok && c.Subreddits[strings.ToLower(subreddit)]
+}
+
+// postBlocked returns true if the post, or the subreddit it came from, is
+// blocked in chatID.
+func (b *blockList) postBlocked(chatID int64, post mediaPost) bool {
+	if b == nil {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	c, ok := b.chats[chatID]
+	if !ok {
+		return false
+	}
+	return c.Posts[post.ID] || (post.Subreddit != "" && c.Subreddits[strings.ToLower(post.Subreddit)])
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
-	"github.com/marcopaganini/pixiebot/reddit"
 	"gopkg.in/telegram-bot-api.v4"
-	"log"
+	"log/slog"
 	"math/rand"
+	"net/url"
+	"strconv"
+	"strings"
 	"time"
 	//"github.com/davecgh/go-spew/spew"
 )
@@ -20,50 +23,180 @@ const (
 
 type tgbotSender interface {
 	Send(tgbotapi.Chattable) (tgbotapi.Message, error)
-}
-
-// redditClientInterface defines an interface between this bot and the reddit package.
-type redditClientInterface interface {
-	RandomMediaURL(string) (string, int, error)
+	MakeRequest(string, url.Values) (tgbotapi.APIResponse, error)
+	AnswerCallbackQuery(tgbotapi.CallbackConfig) (tgbotapi.APIResponse, error)
+	AnswerInlineQuery(tgbotapi.InlineConfig) (tgbotapi.APIResponse, error)
+	UploadFile(string, map[string]string, string, interface{}) (tgbotapi.APIResponse, error)
 }
 
 // botSleepTime keeps the time of the last request for the bot to sleep, per group.
 type botSleepTime map[int64]time.Time
 
-// run is the main message dispatcher for the bot.
-func run(bot tgbotSender, updates tgbotapi.UpdatesChannel, rclient redditClientInterface, triggers TriggerConfig) {
+const (
+	// Callback data kind for the "another one" button.
+	rerollCallback = "again"
+)
+
+// callbackHandler handles a callback query (a press on an inline keyboard
+// button).
+type callbackHandler func(tgbotSender, *tgbotapi.CallbackQuery, botConfig, mediaSources)
+
+// callbackHandlers maps the kind of callback data (the part before the
+// first ":") to the callback handlers.
+var callbackHandlers = map[string]callbackHandler{
+	voteCallback:   handleVote,
+	rerollCallback: handleReroll,
+}
+
+// mediaHandlers maps media types to the functions sending them.
+var mediaHandlers = map[int]func(tgbotSender, sendOptions, string) (tgbotapi.Message, error){
+	// MediaNone: Nothing to do...
+	mediaNone: nil,
+
+	// MediaImageURL: The URL points to an image, so we can upload a
+	// picture directly.
+	mediaImage: sendImageURL,
+
+	// MediaFileURL: The URL points to a file (typically an MP4 file, but
+	// any type playable by Telegram. In this case, we send the URL as a
+	// document.  upload.
+	mediaFile: sendFileURL,
+
+	// Video URL: Simple video url, like youtube. Telegram takes charge of
+	// reading the link and generating a thumbnail.
+	mediaVideo: sendURL,
+
+	// MediaAnimationURL: The URL points to a GIF or silent MP4. Sending
+	// as an animation makes it play inline (photos show a still frame).
+	mediaAnimation: sendAnimationURL,
+}
+
+// run is the main update dispatcher for the bot.
+func run(bot tgbotSender, updates <-chan botUpdate, config botConfig, sources mediaSources) {
 	bsleep := botSleepTime{}
 
 	for update := range updates {
-		if update.Message == nil || update.Message.From.IsBot {
+		health.beat()
+		if update.tick {
 			continue
 		}
+		updatesReceived.Inc()
 
-		chatID := update.Message.Chat.ID
-
-		if update.Message.IsCommand() {
-			msg := tgbotapi.NewMessage(chatID, "")
-
-			switch update.Message.Command() {
-			case "sleep":
-				wake := time.Now().Add(sleepTime)
-				bsleep[chatID] = wake
-				msg.Text = fmt.Sprintf("Sleeping until %s. Zzzzz...", wake.Format(timeFormat))
-			case "wakeup":
-				bsleep[chatID] = time.Now().Add(time.Minute * -1)
-				msg.Text = "Fully awake and ready to serve!"
-			default:
+		switch {
+		case update.CallbackQuery != nil:
+			handleCallback(bot, update.CallbackQuery, config, sources)
+		case update.InlineQuery != nil && config.Inline:
+			handleInlineQuery(bot, update.InlineQuery, sources)
+		default:
+			msg, kind := messageKind(update)
+			if msg == nil {
+				slog.Debug("Ignoring unsupported update", "update_id", update.UpdateID)
 				continue
 			}
-			bot.Send(msg)
-			continue
+			handleMessage(bot, update, msg, kind, config, sources, bsleep)
 		}
+	}
+}
 
-		if sleeping(bsleep, chatID) {
-			continue
+// messageKind returns the message in the update and its kind (one of the
+// update* constants), or nil if the update has no message.
+func messageKind(update botUpdate) (*tgbotapi.Message, string) {
+	switch {
+	case update.Message != nil:
+		if update.Message.ForwardFrom != nil || update.Message.ForwardFromChat != nil {
+			return update.Message, updateForwarded
 		}
+		return update.Message, updateMessage
+	case update.EditedMessage != nil:
+		return update.EditedMessage, updateEditedMessage
+	case update.ChannelPost != nil:
+		return update.ChannelPost, updateChannelPost
+	case update.EditedChannelPost != nil:
+		return update.EditedChannelPost, updateEditedChannelPost
+	}
+	return nil, ""
+}
 
-		handleTriggers(bot, update, rclient, triggers)
+// messageUserID returns the ID of the user who sent msg, or zero if unknown
+// (e.g. channel posts).
+func messageUserID(msg *tgbotapi.Message) int {
+	if msg.From == nil {
+		return 0
+	}
+	return msg.From.ID
+}
+
+// handleMessage handles commands and trigger messages of the given kind.
+func handleMessage(bot tgbotSender, update botUpdate, msg *tgbotapi.Message, kind string, config botConfig, sources mediaSources, bsleep botSleepTime) {
+	if msg.From != nil && msg.From.IsBot {
+		return
+	}
+	// Only channel posts come without a sender.
+	if msg.From == nil && kind != updateChannelPost && kind != updateEditedChannelPost {
+		return
+	}
+
+	chatID := msg.Chat.ID
+
+	// Commands also work in channels (posted by the channel admins).
+	if (kind == updateMessage || kind == updateChannelPost) && msg.IsCommand() {
+		reply := tgbotapi.NewMessage(chatID, "")
+
+		switch msg.Command() {
+		case "sleep":
+			wake := time.Now().Add(sleepTime)
+			bsleep[chatID] = wake
+			reply.Text = fmt.Sprintf("Sleeping until %s. Zzzzz...", wake.Format(timeFormat))
+		case "wakeup":
+			bsleep[chatID] = time.Now().Add(time.Minute * -1)
+			reply.Text = "Fully awake and ready to serve!"
+		case "undo", "delete":
+			if reply.Text = undo(bot, msg); reply.Text == "" {
+				return
+			}
+		default:
+			return
+		}
+		bot.Send(reply)
+		return
+	}
+
+	// Skip updates no trigger rule listens to (e.g. edits, by default).
+	if !config.triggerConfig.listensTo(kind) {
+		return
+	}
+
+	if sleeping(bsleep, chatID) {
+		return
+	}
+
+	// Don't trigger again when a message that already triggered is edited.
+	if (kind == updateEditedMessage || kind == updateEditedChannelPost) && sent.triggeredBy(chatID, msg.MessageID) {
+		return
+	}
+
+	handleTriggers(bot, update, msg, kind, config, sources, bsleep)
+}
+
+// handleCallback dispatches a callback query to the handler for the kind of
+// callback data.
+func handleCallback(bot tgbotSender, cq *tgbotapi.CallbackQuery, config botConfig, sources mediaSources) {
+	kind := strings.SplitN(cq.Data, ":", 2)[0]
+	handler, ok := callbackHandlers[kind]
+	if !ok {
+		slog.Warn("Unknown callback data", "data", cq.Data, "user_id", cq.From.ID)
+		answerCallback(bot, cq, "")
+		return
+	}
+	handler(bot, cq, config, sources)
+}
+
+// answerCallback answers a callback query, showing text (if any) to the
+// user. Telegram clients show a progress indicator until the query is
+// answered.
+func answerCallback(bot tgbotSender, cq *tgbotapi.CallbackQuery, text string) {
+	if _, err := bot.AnswerCallbackQuery(tgbotapi.NewCallback(cq.ID, text)); err != nil {
+		slog.Error("Error answering callback query", "error", err)
 	}
 }
 
@@ -76,119 +209,352 @@ func sleeping(bsleep botSleepTime, id int64) bool {
 }
 
 // handleTriggers checks if the message is a trigger message and emits a picture
-// from the configured subreddit if so.
-func handleTriggers(bot tgbotSender, update tgbotapi.Update, rclient redditClientInterface, triggers TriggerConfig) {
-	handlers := map[int]func(tgbotSender, int64, string) error{
-		// MediaNone: Nothing to do...
-		reddit.MediaNone: nil,
-
-		// MediaImageURL: The URL points to an image, so we can upload a
-		// picture directly.
-		reddit.MediaImageURL: sendImageURL,
+// from the media source configured in the trigger if so. Rules with a channel
+// publish to the channel instead of the triggering chat.
+func handleTriggers(bot tgbotSender, update botUpdate, msg *tgbotapi.Message, kind string, config botConfig, sources mediaSources, bsleep botSleepTime) {
+	logger := slog.With("chat_id", msg.Chat.ID, "user_id", messageUserID(msg), "update", kind)
 
-		// MediaFileURL: The URL points to a file (typically an MP4 file, but
-		// any type playable by Telegram. In this case, we send the URL as a
-		// document.  upload.
-		reddit.MediaFileURL: sendFileURL,
+	rule, ok, err := checkTriggers(msg, kind, config.triggerConfig)
+	if err != nil {
+		logger.Error("Error checking triggers", "error", err)
+		return
+	}
+	if !ok {
+		return
+	}
 
-		// Video URL: Simple video url, like youtube. Telegram takes charge of
-		// reading the link and generating a thumbnail.
-		reddit.MediaVideoURL: sendURL,
+	// Send to the same forum topic as the triggering message, if any.
+	opts := sendOptions{chatID: msg.Chat.ID, threadID: update.threadID}
+	if config.ReplyToTrigger {
+		opts.replyTo = msg.MessageID
 	}
+	if rule.channelID != 0 {
+		// The channel may be sleeping as well.
+		if sleeping(bsleep, rule.channelID) {
+			logger.Debug("Channel is sleeping", "rule", rule.name, "channel_id", rule.channelID)
+			return
+		}
+		opts = sendOptions{chatID: rule.channelID}
+	}
+	trig := postTrigger{chatID: msg.Chat.ID, userID: messageUserID(msg), messageID: msg.MessageID}
+	sendPost(bot, config, sources, rule, opts, trig, logger)
+}
 
-	msg := update.Message.Text
+// handleReroll handles the "another one" button, sending another post from
+// the same subreddit (or source target) as the post with the button. Rerolls
+// work while the bot is sleeping, since they're explicit requests.
+func handleReroll(bot tgbotSender, cq *tgbotapi.CallbackQuery, config botConfig, sources mediaSources) {
+	if cq.Message == nil {
+		answerCallback(bot, cq, "")
+		return
+	}
+	chatID := cq.Message.Chat.ID
+	logger := slog.With("chat_id", chatID, "user_id", cq.From.ID)
 
-	subreddit, ok, err := checkTriggers(msg, triggers)
-	if err != nil {
-		log.Printf("Error checking triggers: %v", err)
+	post := sent.find(chatID, cq.Message.MessageID)
+	if post == nil {
+		answerCallback(bot, cq, "Sorry, I don't remember where this post came from.")
 		return
 	}
+	rule, ok := config.triggerConfig.rule(post.rule)
 	if !ok {
+		answerCallback(bot, cq, "Sorry, this trigger no longer exists.")
 		return
 	}
-	log.Printf("Triggering fetch on %s", subreddit)
+	rule.target = post.subreddit
+	rule.fallback = nil
+
+	// Answer right away, as fetching may take a while.
+	answerCallback(bot, cq, "🔁")
+
+	opts := sendOptions{chatID: chatID, threadID: post.threadID}
+	trig := postTrigger{chatID: chatID, userID: cq.From.ID, messageID: cq.Message.MessageID}
+	sendPost(bot, config, sources, rule, opts, trig, logger.With("reroll", true))
+}
+
+// sendPost fetches a post for rule and sends it as specified in opts. The
+// post is recorded for /undo, votes and rerolls, and in the audit log as a
+// response to trig.
+func sendPost(bot tgbotSender, config botConfig, sources mediaSources, rule TriggerRule, opts sendOptions, trig postTrigger, logger *slog.Logger) {
+	logger = logger.With("rule", rule.name, "source", rule.source)
+
+	src, ok := sources[rule.source]
+	if !ok {
+		logger.Warn("Media source not initialized. Ignoring.")
+		return
+	}
+	logger.Info("Triggering fetch", "target", rule.target, "mode", rule.mode)
 
 	// Dispatch handler using mediaType as key in handlers.
-	mediaURL, mediaType, err := rclient.RandomMediaURL(subreddit)
+	post, err := fetchPost(src, rule, opts.chatID)
 	if err != nil {
-		log.Printf("%v", err)
+		logger.Error("Error fetching post", "error", err)
 		return
 	}
-	handler, ok := handlers[mediaType]
-	if !ok {
-		log.Printf("Media URL is empty. Silently ignoring.")
+	logger = logger.With("subreddit", post.Subreddit, "media_type", mediaTypeName(post.MediaType))
+
+	handler, ok := mediaHandlers[post.MediaType]
+	if !ok || handler == nil {
+		logger.Info("No media found. Silently ignoring.")
 		return
 	}
 
-	if err := handler(bot, update.Message.Chat.ID, mediaURL); err != nil {
-		log.Print(err)
+	opts.replyMarkup = postKeyboard(config, 0, 0)
+	opts.localFile = post.LocalFile
+	sentMsg, err := handler(bot, opts, post.MediaURL)
+	if err != nil {
+		sendFailures.WithLabelValues(mediaTypeName(post.MediaType)).Inc()
+		logger.Error("Error sending media", "error", err)
+		return
+	}
+	logger.Info("Media sent", "media_url", post.MediaURL)
+
+	sent.add(opts.chatID, &sentPost{
+		messageID: sentMsg.MessageID,
+		postID:    post.ID,
+		subreddit: postSubreddit(post, rule),
+		rule:      rule.name,
+		threadID:  opts.threadID,
+		trigger:   trig,
+		votes:     map[int]int{},
+	})
+	if err := audit.write(newAuditRecord(opts.chatID, trig, &sentMsg, rule, post)); err != nil {
+		logger.Error("Error writing audit log", "error", err)
+	}
+}
+
+// postKeyboard returns the inline keyboard attached to the bot's posts, with
+// the given vote counts, or nil if posts have no buttons.
+func postKeyboard(config botConfig, up, down int) *tgbotapi.InlineKeyboardMarkup {
+	var rows [][]tgbotapi.InlineKeyboardButton
+	if config.Votes {
+		rows = append(rows, voteButtons(up, down))
+	}
+	if config.RerollButton {
+		rows = append(rows, tgbotapi.NewInlineKeyboardRow(
+			tgbotapi.NewInlineKeyboardButtonData("🔁 another one", rerollCallback)))
+	}
+	if len(rows) == 0 {
+		return nil
+	}
+	kb := tgbotapi.NewInlineKeyboardMarkup(rows...)
+	return &kb
+}
+
+// fetchPost fetches a post with media for the trigger rule. If a fetch
+// yields no media (or a post blocked in chatID), it rerolls on the same
+// target up to rule.retries times, then tries each of the fallback targets
+// in order (with the same number of rerolls). Errors and targets blocked in
+// chatID move on to the next target. Returns a post with type MediaNone if
+// nothing is found, and the last error seen, if any.
+func fetchPost(src MediaSource, rule TriggerRule, chatID int64) (mediaPost, error) {
+	var lastErr error
+
+	targets := append([]string{rule.target}, rule.fallback...)
+	for _, target := range targets {
+		if blocklist.subredditBlocked(chatID, target) {
+			slog.Debug("Target blocked in chat", "rule", rule.name, "target", target, "chat_id", chatID)
+			continue
+		}
+		for try := 0; try <= rule.retries; try++ {
+			post, err := src.RandomPost(target, rule.mode)
+			if err != nil {
+				slog.Warn("Error fetching post", "rule", rule.name, "target", target, "error", err)
+				lastErr = err
+				break
+			}
+			if blocklist.postBlocked(chatID, post) {
+				slog.Debug("Post blocked in chat", "rule", rule.name, "post_id", post.ID, "chat_id", chatID)
+				continue
+			}
+			if post.MediaType != mediaNone {
+				return post, nil
+			}
+			slog.Debug("No media in post", "rule", rule.name, "target", target, "try", try+1, "tries", rule.retries+1)
+		}
+	}
+	return mediaPost{}, lastErr
+}
+
+// postSubreddit returns the subreddit a post came from, or the rule's target
+// for other sources.
+func postSubreddit(post mediaPost, rule TriggerRule) string {
+	if post.Subreddit != "" {
+		return post.Subreddit
+	}
+	return rule.target
+}
+
+// sendOptions holds the destination of the media sent by the bot.
+type sendOptions struct {
+	chatID int64
+
+	// Message to reply to (zero for none).
+	replyTo int
+
+	// Forum topic to send to (zero for none).
+	threadID int
+
+	// Inline keyboard to attach (nil for none).
+	replyMarkup *tgbotapi.InlineKeyboardMarkup
+
+	// Local file to upload instead of sending the media URL (see
+	// mediaPost.LocalFile). Empty for none.
+	localFile string
+}
+
+// postTrigger identifies what triggered a post: a message (or a button on a
+// message) from a user in a chat. The chat may differ from the one the post
+// is sent to (e.g. rules publishing to a channel).
+type postTrigger struct {
+	chatID    int64
+	userID    int
+	messageID int
+}
+
+// params returns the request parameters for the options.
+func (o sendOptions) params() (map[string]string, error) {
+	params := map[string]string{"chat_id": strconv.FormatInt(o.chatID, 10)}
+	if o.replyTo != 0 {
+		params["reply_to_message_id"] = strconv.Itoa(o.replyTo)
 	}
+	if o.threadID != 0 {
+		params["message_thread_id"] = strconv.Itoa(o.threadID)
+	}
+	if o.replyMarkup != nil {
+		buf, err := json.Marshal(o.replyMarkup)
+		if err != nil {
+			return nil, err
+		}
+		params["reply_markup"] = string(buf)
+	}
+	return params, nil
 }
 
 // sendImageURL sends a photo pointed to by mediaURL to the telegram chat
-// identified by chatID using NewPhotoUpload. This is the ideal way to
-// send URLs that point directly to images, which will immediately show
-// in the group.
-func sendImageURL(bot tgbotSender, chatID int64, mediaURL string) error {
-	// Issue #74 is at play here, preventing us to upload via url.URL:
-	// https://github.com/go-telegram-bot-api/telegram-bot-api/issues/74
-	img := tgbotapi.NewPhotoUpload(chatID, nil)
-	img.FileID = mediaURL
-	img.UseExisting = true
-
-	log.Printf("Sending Image URL: %v\n", img)
-	_, err := bot.Send(img)
+// using sendPhoto. This is the ideal way to send URLs that point directly
+// to images, which will immediately show in the group.
+func sendImageURL(bot tgbotSender, opts sendOptions, mediaURL string) (tgbotapi.Message, error) {
+	slog.Debug("Sending photo", "chat_id", opts.chatID, "url", mediaURL)
+	msg, err := sendMedia(bot, "sendPhoto", "photo", opts, mediaURL)
 	if err != nil {
-		return fmt.Errorf("error sending photo (url: %s): %v", mediaURL, err)
+		return msg, fmt.Errorf("error sending photo (url: %s): %v", mediaURL, err)
 	}
-	return nil
+	return msg, nil
 }
 
-// sendURL sends the media URL as a regular message to the user/group.
-func sendURL(bot tgbotSender, chatID int64, mediaURL string) error {
-	msg := tgbotapi.NewMessage(chatID, mediaURL)
+// sendAnimationURL sends the animation (GIF or silent MP4) pointed to by
+// mediaURL using sendAnimation, so it plays inline in the chat.
+func sendAnimationURL(bot tgbotSender, opts sendOptions, mediaURL string) (tgbotapi.Message, error) {
+	slog.Debug("Sending animation", "chat_id", opts.chatID, "url", mediaURL)
+	msg, err := sendMedia(bot, "sendAnimation", "animation", opts, mediaURL)
+	if err != nil {
+		return msg, fmt.Errorf("error sending animation URL (url: %s): %v", mediaURL, err)
+	}
+	return msg, nil
+}
 
-	log.Printf("Sending URL: %v\n", msg)
-	_, err := bot.Send(msg)
+// sendURL sends the media URL as a regular message to the user/group.
+func sendURL(bot tgbotSender, opts sendOptions, mediaURL string) (tgbotapi.Message, error) {
+	params, err := opts.params()
 	if err != nil {
-		return fmt.Errorf("error sending media URL (url: %s): %v", mediaURL, err)
+		return tgbotapi.Message{}, err
 	}
+	v := url.Values{}
+	for k, p := range params {
+		v.Set(k, p)
+	}
+	v.Set("text", mediaURL)
 
-	return nil
+	slog.Debug("Sending URL", "chat_id", opts.chatID, "url", mediaURL)
+	resp, err := bot.MakeRequest("sendMessage", v)
+	if err != nil {
+		return tgbotapi.Message{}, fmt.Errorf("error sending media URL (url: %s): %v", mediaURL, err)
+	}
+	return decodeMessage(resp)
 }
 
 // sendFileURL sends the media URL that points to a Telegram playable file
-// (usually an MP4 video) using NewDocumentUpload. Use sendPhoto instead if
+// (usually an MP4 video) using sendDocument. Use sendImageURL instead if
 // the URL points directly to an image.
-func sendFileURL(bot tgbotSender, chatID int64, mediaURL string) error {
-	doc := tgbotapi.NewDocumentUpload(chatID, nil)
-	doc.FileID = mediaURL
-	doc.UseExisting = true
+func sendFileURL(bot tgbotSender, opts sendOptions, mediaURL string) (tgbotapi.Message, error) {
+	slog.Debug("Sending file", "chat_id", opts.chatID, "url", mediaURL)
+	msg, err := sendMedia(bot, "sendDocument", "document", opts, mediaURL)
+	if err != nil {
+		return msg, fmt.Errorf("error sending file URL (url: %s): %v", mediaURL, err)
+	}
+	return msg, nil
+}
 
-	log.Printf("Sending File URL: %v\n", doc)
-	_, err := bot.Send(doc)
+// sendMedia sends mediaURL using the Telegram API method, with the media in
+// the given field. The URL is passed as is, and Telegram fetches it
+// directly, unless opts has a local file to upload instead. Returns the
+// message sent.
+//
+// We don't use tgbotapi's configs (and Send) here since they don't support
+// message_thread_id (forum topics).
+func sendMedia(bot tgbotSender, method, field string, opts sendOptions, mediaURL string) (tgbotapi.Message, error) {
+	params, err := opts.params()
 	if err != nil {
-		return fmt.Errorf("error sending file URL (url: %s): %v", mediaURL, err)
+		return tgbotapi.Message{}, err
 	}
 
-	return nil
+	var resp tgbotapi.APIResponse
+	if opts.localFile != "" {
+		resp, err = bot.UploadFile(method, params, field, opts.localFile)
+	} else {
+		v := url.Values{}
+		for k, p := range params {
+			v.Set(k, p)
+		}
+		v.Set(field, mediaURL)
+		resp, err = bot.MakeRequest(method, v)
+	}
+	if err != nil {
+		return tgbotapi.Message{}, err
+	}
+	return decodeMessage(resp)
 }
 
-// checkTriggers returns the name of a subreddit if the current message matches any of the
-// trigger messages configured for that subreddit.
-func checkTriggers(msg string, triggers TriggerConfig) (string, bool, error) {
+// decodeMessage returns the message in the result of an API response.
+func decodeMessage(resp tgbotapi.APIResponse) (tgbotapi.Message, error) {
+	var msg tgbotapi.Message
+	if err := json.Unmarshal(resp.Result, &msg); err != nil {
+		return msg, fmt.Errorf("error decoding message: %v", err)
+	}
+	return msg, nil
+}
+
+// matches returns true if the rule's regex matches the message text, or the
+// caption of media messages, if enabled for the rule.
+func (rule TriggerRule) matches(msg *tgbotapi.Message) bool {
+	if rule.regex.MatchString(msg.Text) {
+		return true
+	}
+	return rule.captions && msg.Caption != "" && rule.regex.MatchString(msg.Caption)
+}
+
+// checkTriggers returns the first trigger rule listening to the kind of
+// update and matching the current message (and winning the dice roll).
+func checkTriggers(msg *tgbotapi.Message, kind string, triggers TriggerConfig) (TriggerRule, bool, error) {
 	for _, rule := range triggers {
+		if !rule.updates[kind] {
+			continue
+		}
 		// Attempt to match regexp.
-		if !rule.regex.MatchString(msg) {
+		if !rule.matches(msg) {
 			continue
 		}
-		// Throw dice on percentage.
+		// Throw dice on percentage (adjusted by votes, if enabled).
+		pct := votes.percentage(rule)
 		rnd := (rand.Int() % 100) + 1
-		if rule.percentage <= rnd {
-			log.Printf("No dice for subreddit %s! Wanted [1-%d], got %d\n", rule.subreddit, rule.percentage, rnd)
+		if pct <= rnd {
+			diceLost.WithLabelValues(rule.name).Inc()
+			slog.Debug("No dice", "rule", rule.name, "wanted", fmt.Sprintf("[1-%d]", pct), "got", rnd)
 			continue
 		}
-		return rule.subreddit, true, nil
+		triggerMatches.WithLabelValues(rule.name).Inc()
+		return rule, true, nil
 	}
-	return "", false, nil
+	return TriggerRule{}, false, nil
 }
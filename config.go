@@ -4,11 +4,15 @@ import (
 	"errors"
 	"fmt"
 	"github.com/BurntSushi/toml"
+	"github.com/marcopaganini/pixiebot/reddit"
+	"gopkg.in/telegram-bot-api.v4"
 	"io/ioutil"
 	"os"
 	"os/user"
 	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
 )
 
 const (
@@ -16,13 +20,55 @@ const (
 
 	// Directory usually under $HOME/.config that holds all configurations.
 	botConfigDir = "pixiebot"
+
+	// Directory usually under $HOME/.local/state that holds persistent state.
+	botStateDir = "pixiebot"
+
+	// File under the state directory holding the reddit refresh token.
+	refreshTokenFile = "reddit_refresh_token"
+
+	// File under the state directory holding the per-chat blocklist.
+	blocklistFile = "blocklist.json"
+
+	// File under the state directory holding the votes on the bot's posts.
+	votesFile = "votes.json"
+
+	// File under the state directory holding the audit log.
+	auditLogFile = "audit.jsonl"
+
+	// Default redirect URI for the reddit authorization code flow. This must
+	// match the redirect URI configured in the reddit app.
+	defaultRedirectURI = "http://localhost:8080/authorize_callback"
 )
 
+// Kinds of updates a trigger rule can listen to.
+const (
+	updateMessage           = "message"
+	updateForwarded         = "forwarded"
+	updateEditedMessage     = "edited_message"
+	updateChannelPost       = "channel_post"
+	updateEditedChannelPost = "edited_channel_post"
+)
+
+// updateKinds holds the valid update kinds for trigger rules.
+var updateKinds = []string{updateMessage, updateForwarded, updateEditedMessage, updateChannelPost, updateEditedChannelPost}
+
+// defaultUpdateKinds are the update kinds rules listen to by default.
+var defaultUpdateKinds = []string{updateMessage, updateForwarded}
+
 // TOMLTriggerRule represents a configuration map in TOML.
 type TOMLTriggerRule struct {
-	Subreddit  string `toml:"subreddit"`
-	Regex      string `toml:"regex"`
-	Percentage int    `toml:"percentage"`
+	Source     string   `toml:"source"`
+	Target     string   `toml:"target"`
+	Subreddit  string   `toml:"subreddit"`
+	Mode       string   `toml:"mode"`
+	Retries    int      `toml:"retries"`
+	Fallback   []string `toml:"fallback"`
+	Regex      string   `toml:"regex"`
+	Percentage int      `toml:"percentage"`
+	Updates    []string `toml:"updates"`
+	Captions   bool     `toml:"captions"`
+	Channel    string   `toml:"channel"`
 }
 
 // TOMLTriggerConfig is a map of TOML trigger configs.
@@ -30,9 +76,32 @@ type TOMLTriggerConfig map[string]TOMLTriggerRule
 
 // TriggerRule stores the in-memory (parsed & sanitized) trigger config.
 type TriggerRule struct {
-	subreddit  string
-	regex      *regexp.Regexp
+	// Rule name (the key in the TOML file).
+	name string
+
+	// Media source name and source specific target (e.g. subreddit).
+	source string
+	target string
+	mode   string
+	regex  *regexp.Regexp
+
+	// Number of times to reroll on the same target when a fetch yields no
+	// media, and ordered list of targets to try after that.
+	retries  int
+	fallback []string
+
 	percentage int
+
+	// Kinds of updates the rule listens to, and whether to match the
+	// captions of media messages.
+	updates  map[string]bool
+	captions bool
+
+	// Channel to publish posts to instead of the triggering chat, as
+	// configured (@username or chat ID) and resolved to a chat ID (see
+	// resolveChannels).
+	channel   string
+	channelID int64
 }
 
 // TriggerConfig holds a collection of trigger rules.
@@ -46,9 +115,71 @@ type botConfig struct {
 	ClientID string `toml:"client_id"`
 	Secret   string `toml:"secret"`
 
+	// Reddit OAuth grant type (password, client_credentials,
+	// installed_client or refresh_token) and device ID for the
+	// installed_client grant.
+	Grant    string `toml:"grant"`
+	DeviceID string `toml:"device_id"`
+
+	// Time to keep subreddit listings in the cache (e.g. "10m").
+	ListingTTL string `toml:"listing_ttl"`
+
+	// Imgur API client ID, used to resolve imgur albums.
+	ImgurClientID string `toml:"imgur_client_id"`
+
+	// Limits for preview images: width + height in pixels and file size in
+	// bytes (0 = Telegram's limits).
+	PreviewMaxSize  int64 `toml:"preview_max_size"`
+	PreviewMaxBytes int64 `toml:"preview_max_bytes"`
+
+	// Number of posts to prefetch per subreddit (0 = disabled).
+	Prefetch int `toml:"prefetch"`
+
+	// Redirect URI for the reddit authorization code flow.
+	RedirectURI string `toml:"redirect_uri"`
+
+	// Refresh token read from the state directory (refresh_token grant).
+	refreshToken string
+
 	// Telegram Token
 	Token string `toml:"token"`
 
+	// Local directory media source configuration.
+	Local localConfig `toml:"local"`
+
+	// RSS/Atom feed media source configuration.
+	RSS feedConfig `toml:"rss"`
+
+	// Logging configuration.
+	Log logConfig `toml:"log"`
+
+	// Log every Telegram API request and response (at the debug level).
+	TelegramDebug bool `toml:"telegram_debug"`
+
+	// Send media as a reply to the message that triggered it.
+	ReplyToTrigger bool `toml:"reply_to_trigger"`
+
+	// Attach vote buttons (👍/👎) to the bot's posts.
+	Votes bool `toml:"votes"`
+
+	// Adjust the percentage of the trigger rules based on the votes.
+	VoteTuning bool `toml:"vote_tuning"`
+
+	// Attach an "another one" button to the bot's posts, sending another
+	// post from the same subreddit.
+	RerollButton bool `toml:"reroll_button"`
+
+	// Answer inline queries (@bot <subreddit>) with posts from reddit.
+	Inline bool `toml:"inline"`
+
+	// Audit log file (JSON lines). Defaults to auditLogFile under the state
+	// directory.
+	AuditLog string `toml:"audit_log"`
+
+	// Address (host:port) for the HTTP server exposing /metrics, /healthz
+	// and /readyz. Empty disables the server.
+	HTTPListen string `toml:"http_listen"`
+
 	// Trigger config as represented in the TOML file.
 	TOMLTriggerConfig TOMLTriggerConfig `toml:"triggers"`
 
@@ -58,8 +189,10 @@ type botConfig struct {
 
 // loadConfig loads the configuration items for the bot from 'configFile' under
 // the home directory, and assigns sane defaults to certain configuration
-// items.  Returns a filled-in botConfig object.
-func loadConfig() (botConfig, error) {
+// items.  Returns a filled-in botConfig object. When authorizing (see
+// redditAuthorize), the reddit credentials for the configured grant are not
+// required, since the refresh token doesn't exist yet.
+func loadConfig(authorize bool) (botConfig, error) {
 	config := botConfig{}
 
 	cfgdir, err := configDir()
@@ -76,9 +209,32 @@ func loadConfig() (botConfig, error) {
 		return botConfig{}, err
 	}
 
-	// Check mandatory fields.
-	if config.Username == "" || config.Password == "" || config.ClientID == "" || config.Secret == "" {
-		return botConfig{}, errors.New("usename/password/client_id/secret cannot be null")
+	if config.RedirectURI == "" {
+		config.RedirectURI = defaultRedirectURI
+	}
+
+	if config.AuditLog == "" {
+		dir, err := stateDir()
+		if err != nil {
+			return botConfig{}, err
+		}
+		config.AuditLog = filepath.Join(dir, auditLogFile)
+	}
+
+	// Use the refresh token saved by -reddit-authorize, if present.
+	tok, err := loadRefreshToken()
+	if err != nil {
+		return botConfig{}, err
+	}
+	config.refreshToken = tok
+
+	// Default to the refresh_token grant once the bot has been authorized
+	// (or while authorizing).
+	if config.Grant == "" {
+		config.Grant = reddit.GrantPassword
+		if config.refreshToken != "" || authorize {
+			config.Grant = reddit.GrantRefreshToken
+		}
 	}
 
 	tc, err := buildTriggerConfig(config)
@@ -88,9 +244,47 @@ func loadConfig() (botConfig, error) {
 
 	config.triggerConfig = tc
 
+	if config.PreviewMaxSize < 0 || config.PreviewMaxBytes < 0 {
+		return botConfig{}, errors.New("preview_max_size/preview_max_bytes must be zero or positive")
+	}
+
+	if config.Prefetch < 0 {
+		return botConfig{}, fmt.Errorf("prefetch must be zero or positive, got %d", config.Prefetch)
+	}
+
+	// Reddit credentials are only needed if a trigger (or inline mode)
+	// uses reddit. The authorization flow checks what it needs.
+	if (tc.usesSource("reddit") || config.Inline) && !authorize {
+		if err := checkRedditConfig(config); err != nil {
+			return botConfig{}, err
+		}
+	}
+
 	return config, nil
 }
 
+// checkRedditConfig checks the mandatory reddit configuration fields. Which
+// ones are required depends on the grant.
+func checkRedditConfig(config botConfig) error {
+	switch config.Grant {
+	case reddit.GrantPassword:
+		if config.Username == "" || config.Password == "" || config.ClientID == "" || config.Secret == "" {
+			return errors.New("usename/password/client_id/secret cannot be null")
+		}
+	case reddit.GrantClientCredentials:
+		if config.ClientID == "" || config.Secret == "" {
+			return errors.New("client_id/secret cannot be null")
+		}
+	case reddit.GrantInstalledClient, reddit.GrantRefreshToken:
+		if config.ClientID == "" {
+			return errors.New("client_id cannot be null")
+		}
+	default:
+		return fmt.Errorf("invalid grant: %q", config.Grant)
+	}
+	return nil
+}
+
 // buildTriggerConfig builds a trigger configuration based on the loaded config.
 func buildTriggerConfig(config botConfig) (TriggerConfig, error) {
 	// First, fetch every key and order. We want keys to be processed in sequence.
@@ -109,9 +303,66 @@ func buildTriggerConfig(config botConfig) (TriggerConfig, error) {
 		}
 
 		tr := TriggerRule{}
-		tr.subreddit = fileRule.Subreddit
+		tr.name = k
+		tr.source = fileRule.Source
+		tr.target = fileRule.Target
 		tr.percentage = fileRule.Percentage
 
+		// Source defaults to reddit. "subreddit" is an alias for target.
+		if tr.source == "" {
+			tr.source = defaultSource
+		}
+		if _, ok := sourceFactories[tr.source]; !ok {
+			return TriggerConfig{}, fmt.Errorf("trigger %q: unknown source %q (valid sources: %s)", k, tr.source, strings.Join(sourceNames(), ", "))
+		}
+		if tr.target == "" {
+			tr.target = fileRule.Subreddit
+		}
+		if tr.target == "" {
+			return TriggerConfig{}, fmt.Errorf("trigger %q: target cannot be empty", k)
+		}
+
+		// Fetch mode (reddit only).
+		tr.mode = fileRule.Mode
+		if tr.mode != "" && tr.source != "reddit" {
+			return TriggerConfig{}, fmt.Errorf("trigger %q: mode is only supported by the reddit source", k)
+		}
+		if err := reddit.ValidMode(tr.mode); err != nil {
+			return TriggerConfig{}, fmt.Errorf("trigger %q: %v", k, err)
+		}
+
+		// Rerolls and fallback targets.
+		if fileRule.Retries < 0 {
+			return TriggerConfig{}, fmt.Errorf("trigger %q: retries must be zero or positive, got %d", k, fileRule.Retries)
+		}
+		tr.retries = fileRule.Retries
+		tr.fallback = fileRule.Fallback
+
+		// Update kinds and captions.
+		kinds := fileRule.Updates
+		if len(kinds) == 0 {
+			kinds = defaultUpdateKinds
+		}
+		tr.updates = map[string]bool{}
+		for _, kind := range kinds {
+			if !stringInSlice(kind, updateKinds) {
+				return TriggerConfig{}, fmt.Errorf("trigger %q: unknown update kind %q (valid kinds: %s)", k, kind, strings.Join(updateKinds, ", "))
+			}
+			tr.updates[kind] = true
+		}
+		tr.captions = fileRule.Captions
+
+		// Publish to a channel. Usernames are resolved into chat IDs
+		// once the bot is connected to Telegram.
+		tr.channel = fileRule.Channel
+		if tr.channel != "" && !strings.HasPrefix(tr.channel, "@") {
+			id, err := strconv.ParseInt(tr.channel, 10, 64)
+			if err != nil {
+				return TriggerConfig{}, fmt.Errorf("trigger %q: channel must be a @username or chat ID, got %q", k, tr.channel)
+			}
+			tr.channelID = id
+		}
+
 		// Convert regex to a compiled object for later use.
 		var err error
 		tr.regex, err = regexp.Compile(fileRule.Regex)
@@ -124,6 +375,95 @@ func buildTriggerConfig(config botConfig) (TriggerConfig, error) {
 	return tc, nil
 }
 
+// resolveChannels resolves the channel usernames in the trigger rules into
+// chat IDs. The bot must be a member (administrator, to post) of the
+// channels.
+func (tc TriggerConfig) resolveChannels(bot *tgbotapi.BotAPI) error {
+	for i, rule := range tc {
+		if rule.channel == "" || rule.channelID != 0 {
+			continue
+		}
+		chat, err := bot.GetChat(tgbotapi.ChatConfig{SuperGroupUsername: rule.channel})
+		if err != nil {
+			return fmt.Errorf("trigger %q: error looking up channel %s: %v", rule.name, rule.channel, err)
+		}
+		tc[i].channelID = chat.ID
+	}
+	return nil
+}
+
+// listensTo returns true if any of the trigger rules listens to the update
+// kind.
+func (tc TriggerConfig) listensTo(kind string) bool {
+	for _, rule := range tc {
+		if rule.updates[kind] {
+			return true
+		}
+	}
+	return false
+}
+
+// stringInSlice returns true if s is in the slice.
+func stringInSlice(s string, slice []string) bool {
+	for _, v := range slice {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// rule returns the trigger rule with the given name.
+func (tc TriggerConfig) rule(name string) (TriggerRule, bool) {
+	for _, rule := range tc {
+		if rule.name == name {
+			return rule, true
+		}
+	}
+	return TriggerRule{}, false
+}
+
+// usesSource returns true if any of the trigger rules uses the named source.
+func (tc TriggerConfig) usesSource(name string) bool {
+	for _, rule := range tc {
+		if rule.source == name {
+			return true
+		}
+	}
+	return false
+}
+
+// loadRefreshToken returns the reddit refresh token saved in the state
+// directory, or an empty string if the file does not exist.
+func loadRefreshToken() (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(dir, refreshTokenFile))
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(buf)), nil
+}
+
+// saveRefreshToken saves the reddit refresh token to the state directory,
+// creating the directory if needed. The file is only readable by the owner.
+func saveRefreshToken(tok string) (string, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	f := filepath.Join(dir, refreshTokenFile)
+	return f, ioutil.WriteFile(f, []byte(tok+"\n"), 0600)
+}
+
 // homeDir returns the user's home directory or an error if the variable HOME
 // is not set, or os.user fails, or the directory cannot be found.
 func homeDir() (string, error) {
@@ -161,3 +501,18 @@ func configDir() (string, error) {
 	}
 	return filepath.Join(home, ".config", botConfigDir), nil
 }
+
+// stateDir returns the location for persistent state files. Use the
+// XDG_STATE_HOME environment variable, or the fallback value of
+// $HOME/.local/state if the variable is not set.
+func stateDir() (string, error) {
+	xdg := os.Getenv("XDG_STATE_HOME")
+	if xdg != "" {
+		return filepath.Join(xdg, botStateDir), nil
+	}
+	home, err := homeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".local", "state", botStateDir), nil
+}
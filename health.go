@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"github.com/marcopaganini/pixiebot/reddit"
+	"gopkg.in/telegram-bot-api.v4"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The bot is considered dead if the update loop hasn't received an update
+// or tick for this long. Ticks are sent after every empty poll, so a stuck
+// update loop fails the liveness probe even if polling still works.
+const maxUpdateIdle = 3 * updatesTimeout * time.Second
+
+// tokenSource is implemented by media sources that need an OAuth token
+// (reddit).
+type tokenSource interface {
+	Token() (*reddit.Token, error)
+}
+
+// healthState tracks the liveness and readiness of the bot.
+type healthState struct {
+	mu sync.Mutex
+
+	// Last time the update loop received an update or tick.
+	lastBeat time.Time
+
+	// Maximum time between beats for the bot to be considered alive.
+	maxIdle time.Duration
+
+	// Readiness check. Nil until the bot is initialized.
+	ready func() error
+}
+
+// health holds the health state of the bot.
+var health = &healthState{maxIdle: maxUpdateIdle}
+
+// beat records that the update loop is alive.
+func (h *healthState) beat() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.lastBeat = time.Now()
+}
+
+// setReadyCheck sets the function used to check readiness.
+func (h *healthState) setReadyCheck(f func() error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.ready = f
+}
+
+// alive returns an error if the update loop hasn't been seen recently. The
+// bot is considered alive until the update loop starts.
+func (h *healthState) alive() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.lastBeat.IsZero() {
+		return nil
+	}
+	if idle := time.Since(h.lastBeat); idle > h.maxIdle {
+		return fmt.Errorf("no updates received in %v", idle.Round(time.Second))
+	}
+	return nil
+}
+
+// readiness runs the readiness check.
+func (h *healthState) readiness() error {
+	h.mu.Lock()
+	ready := h.ready
+	h.mu.Unlock()
+
+	if ready == nil {
+		return fmt.Errorf("bot not initialized")
+	}
+	return ready()
+}
+
+// healthz is the HTTP handler for the liveness probe.
+func (h *healthState) healthz(w http.ResponseWriter, _ *http.Request) {
+	writeHealth(w, h.alive())
+}
+
+// readyz is the HTTP handler for the readiness probe.
+func (h *healthState) readyz(w http.ResponseWriter, _ *http.Request) {
+	writeHealth(w, h.readiness())
+}
+
+// writeHealth writes "ok", or the error with a 503 status code.
+func writeHealth(w http.ResponseWriter, err error) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// botReady returns a readiness check for the bot: all media sources needing
+// a token must have a valid one, and Telegram must answer getMe.
+func botReady(bot *tgbotapi.BotAPI, sources mediaSources) func() error {
+	return func() error {
+		for name, src := range sources {
+			ts, ok := src.(tokenSource)
+			if !ok {
+				continue
+			}
+			if _, err := ts.Token(); err != nil {
+				return fmt.Errorf("%s: no valid token: %v", name, err)
+			}
+		}
+		if _, err := bot.GetMe(); err != nil {
+			return fmt.Errorf("telegram getMe failed: %v", err)
+		}
+		return nil
+	}
+}
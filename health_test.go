@@ -0,0 +1,67 @@
+package main
+
+import (
+	"gopkg.in/telegram-bot-api.v4"
+	"testing"
+	"time"
+)
+
+// blockingBot is a tgbotSender blocking on callback query answers until
+// release is closed.
+type blockingBot struct {
+	tgbotSender
+	release chan struct{}
+}
+
+func (b blockingBot) AnswerCallbackQuery(tgbotapi.CallbackConfig) (tgbotapi.APIResponse, error) {
+	<-b.release
+	return tgbotapi.APIResponse{Ok: true}, nil
+}
+
+func TestAliveStuckDispatcher(t *testing.T) {
+	old := health
+	health = &healthState{maxIdle: 200 * time.Millisecond}
+	defer func() { health = old }()
+
+	bot := blockingBot{release: make(chan struct{})}
+	updates := make(chan botUpdate, 10)
+	done := make(chan struct{})
+	go func() {
+		run(bot, updates, botConfig{}, mediaSources{})
+		close(done)
+	}()
+	defer func() {
+		close(bot.release)
+		close(updates)
+		<-done
+	}()
+
+	// Ticks keep the bot alive while the update loop is idle.
+	for i := 0; i < 3; i++ {
+		updates <- botUpdate{tick: true}
+		time.Sleep(100 * time.Millisecond)
+		if err := health.alive(); err != nil {
+			t.Fatalf("alive with ticks: %v", err)
+		}
+	}
+
+	// The update loop blocks handling a callback query. The poller keeps
+	// sending ticks, but nobody records them.
+	updates <- botUpdate{Update: tgbotapi.Update{CallbackQuery: &tgbotapi.CallbackQuery{
+		ID:   "1",
+		From: &tgbotapi.User{ID: 1},
+		Data: "unknown",
+	}}}
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		select {
+		case updates <- botUpdate{tick: true}:
+		default:
+		}
+		if health.alive() != nil {
+			return
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Errorf("alive returned no error with a stuck update loop")
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"fmt"
+	"github.com/marcopaganini/pixiebot/reddit"
+	"gopkg.in/telegram-bot-api.v4"
+	"log/slog"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// Maximum number of results returned for an inline query.
+	inlineResults = 8
+
+	// Listing mode used for inline queries when none is given. Listings are
+	// cached, so this keeps queries fast and easy on the reddit API.
+	defaultInlineMode = "hot"
+
+	// Time (in seconds) Telegram may cache the results of an inline query.
+	inlineCacheTime = 300
+
+	// Maximum number of inline queries handled at the same time. Queries
+	// arriving while all slots are busy get no results.
+	maxInlineQueries = 4
+
+	// Maximum time spent fetching posts for an inline query. The query is
+	// answered with the posts fetched so far when it expires.
+	inlineTimeout = 5 * time.Second
+)
+
+// subredditRegex matches valid subreddit names.
+var subredditRegex = regexp.MustCompile(`^[A-Za-z0-9_]{2,21}$`)
+
+// inlineSlots limits the number of inline queries handled at once.
+var inlineSlots = make(chan struct{}, maxInlineQueries)
+
+// parseInlineQuery returns the subreddit and listing mode in an inline query
+// ("<subreddit> [mode]", e.g. "aww" or "r/aww top:week").
+func parseInlineQuery(query string) (string, string, error) {
+	fields := strings.Fields(query)
+	if len(fields) == 0 || len(fields) > 2 {
+		return "", "", fmt.Errorf("invalid query: %q", query)
+	}
+	sub := strings.TrimPrefix(strings.TrimPrefix(fields[0], "/"), "r/")
+	if !subredditRegex.MatchString(sub) {
+		return "", "", fmt.Errorf("invalid subreddit: %q", sub)
+	}
+	mode := defaultInlineMode
+	if len(fields) == 2 {
+		mode = fields[1]
+		if err := reddit.ValidMode(mode); err != nil {
+			return "", "", err
+		}
+	}
+	return sub, mode, nil
+}
+
+// handleInlineQuery answers an inline query (@bot <subreddit> [mode]) with
+// a few posts from the subreddit. Queries are handled in the background
+// since they arrive as the user types, and fetching can take a while.
+func handleInlineQuery(bot tgbotSender, iq *tgbotapi.InlineQuery, sources mediaSources) {
+	src, ok := sources["reddit"]
+	if !ok {
+		return
+	}
+	// Prefetched posts are kept for the triggers.
+	if p, ok := src.(*prefetchSource); ok {
+		src = p.src
+	}
+	select {
+	case inlineSlots <- struct{}{}:
+	default:
+		slog.Debug("Too many inline queries, ignoring", "query", iq.Query)
+		return
+	}
+
+	go func() {
+		defer func() { <-inlineSlots }()
+		answerInlineQuery(bot, iq, src)
+	}()
+}
+
+// answerInlineQuery fetches posts for the inline query from src and
+// answers it.
+func answerInlineQuery(bot tgbotSender, iq *tgbotapi.InlineQuery, src MediaSource) {
+	logger := slog.With("user_id", iq.From.ID, "query", iq.Query)
+
+	sub, mode, err := parseInlineQuery(iq.Query)
+	if err != nil {
+		// Partial queries are expected while the user types.
+		logger.Debug("Ignoring inline query", "error", err)
+		return
+	}
+	logger = logger.With("subreddit", sub, "mode", mode)
+
+	results := []interface{}{}
+	seen := map[string]bool{}
+	posts, stop := fetchInlinePosts(src, sub, mode, logger)
+	timeout := time.After(inlineTimeout)
+collect:
+	for len(results) < inlineResults {
+		select {
+		case post, ok := <-posts:
+			if !ok {
+				break collect
+			}
+			if seen[post.ID] {
+				continue
+			}
+			seen[post.ID] = true
+			if r := inlineResult(post); r != nil {
+				results = append(results, r)
+			}
+		case <-timeout:
+			logger.Warn("Timeout fetching posts for inline query", "timeout", inlineTimeout, "results", len(results))
+			break collect
+		}
+	}
+	close(stop)
+
+	_, err = bot.AnswerInlineQuery(tgbotapi.InlineConfig{
+		InlineQueryID: iq.ID,
+		Results:       results,
+		CacheTime:     inlineCacheTime,
+	})
+	if err != nil {
+		logger.Error("Error answering inline query", "error", err)
+		return
+	}
+	inlineQueries.Inc()
+	logger.Info("Inline query answered", "results", len(results))
+}
+
+// fetchInlinePosts fetches posts from src in the background and sends them
+// to the returned channel, which is closed when done. Fetching stops early
+// when the returned stop channel is closed. Posts are picked at random, so
+// we may get the same post more than once: give up after a few tries.
+func fetchInlinePosts(src MediaSource, sub, mode string, logger *slog.Logger) (<-chan mediaPost, chan struct{}) {
+	posts := make(chan mediaPost)
+	stop := make(chan struct{})
+
+	go func() {
+		defer close(posts)
+		for try := 0; try < 2*inlineResults; try++ {
+			post, err := src.RandomPost(sub, mode)
+			if err != nil {
+				logger.Warn("Error fetching post for inline query", "error", err)
+				return
+			}
+			select {
+			case posts <- post:
+			case <-stop:
+				return
+			}
+		}
+	}()
+	return posts, stop
+}
+
+// inlineResult returns the inline query result for post, or nil if the post
+// can't be sent as an inline result. Telegram requires thumbnails for all
+// result types but photos.
+func inlineResult(post mediaPost) interface{} {
+	switch post.MediaType {
+	case mediaImage:
+		thumb := post.Thumbnail
+		if thumb == "" {
+			thumb = post.MediaURL
+		}
+		return tgbotapi.NewInlineQueryResultPhotoWithThumb(post.ID, post.MediaURL, thumb)
+
+	case mediaAnimation:
+		if post.Thumbnail == "" {
+			return nil
+		}
+		if strings.HasSuffix(strings.ToLower(post.MediaURL), ".gif") {
+			r := tgbotapi.NewInlineQueryResultGIF(post.ID, post.MediaURL)
+			r.ThumbURL = post.Thumbnail
+			r.Title = post.Title
+			return r
+		}
+		r := tgbotapi.NewInlineQueryResultMPEG4GIF(post.ID, post.MediaURL)
+		r.ThumbURL = post.Thumbnail
+		r.Title = post.Title
+		return r
+
+	case mediaFile, mediaVideo:
+		if post.Thumbnail == "" {
+			return nil
+		}
+		r := tgbotapi.NewInlineQueryResultVideo(post.ID, post.MediaURL)
+		r.MimeType = "video/mp4"
+		if post.MediaType == mediaVideo {
+			// Embedded players (e.g. youtube).
+			r.MimeType = "text/html"
+		}
+		r.ThumbURL = post.Thumbnail
+		r.Title = post.Title
+		return r
+	}
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/telegram-bot-api.v4"
+	"testing"
+	"time"
+)
+
+// countingSource is a MediaSource returning distinct image posts.
+type countingSource struct {
+	n chan int
+}
+
+func (s *countingSource) RandomPost(string, string) (mediaPost, error) {
+	n := <-s.n
+	s.n <- n + 1
+	id := fmt.Sprintf("p%d", n)
+	return mediaPost{ID: id, MediaURL: "https://example.com/" + id + ".jpg", MediaType: mediaImage}, nil
+}
+
+// inlineBot is a tgbotSender recording inline query answers.
+type inlineBot struct {
+	tgbotSender
+	answers chan tgbotapi.InlineConfig
+}
+
+func (b inlineBot) AnswerInlineQuery(c tgbotapi.InlineConfig) (tgbotapi.APIResponse, error) {
+	b.answers <- c
+	return tgbotapi.APIResponse{Ok: true}, nil
+}
+
+func TestInlineQuerySkipsPrefetch(t *testing.T) {
+	src := &countingSource{n: make(chan int, 1)}
+	src.n <- 0
+	pool := make(chan mediaPost, 1)
+	pool <- mediaPost{ID: "prefetched"}
+	ps := &prefetchSource{src: src, pools: map[prefetchKey]chan mediaPost{
+		{target: "aww", mode: defaultInlineMode}: pool,
+	}}
+
+	bot := inlineBot{answers: make(chan tgbotapi.InlineConfig, 1)}
+	handleInlineQuery(bot, &tgbotapi.InlineQuery{ID: "1", From: &tgbotapi.User{ID: 1}, Query: "aww"}, mediaSources{"reddit": ps})
+
+	select {
+	case answer := <-bot.answers:
+		if len(answer.Results) != inlineResults {
+			t.Errorf("got %d results, want %d", len(answer.Results), inlineResults)
+		}
+	case <-time.After(inlineTimeout + time.Second):
+		t.Fatal("inline query not answered")
+	}
+	if len(pool) != 1 {
+		t.Errorf("inline query used the prefetch pool")
+	}
+}
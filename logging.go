@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"gopkg.in/telegram-bot-api.v4"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// logConfig holds the logging configuration.
+type logConfig struct {
+	// Minimum level to log: debug, info (default), warn or error.
+	Level string `toml:"level"`
+	// Output format: text (default) or json.
+	Format string `toml:"format"`
+	// Where to log: stderr (default), stdout or a file name (appended to).
+	Output string `toml:"output"`
+}
+
+// setupLogging sets the default slog logger according to config. Messages
+// from the standard log package and the Telegram library are routed to the
+// same handler.
+func setupLogging(config logConfig) error {
+	var level slog.Level
+	if config.Level != "" {
+		if err := level.UnmarshalText([]byte(config.Level)); err != nil {
+			return fmt.Errorf("invalid log level: %q", config.Level)
+		}
+	}
+
+	var w io.Writer
+	switch config.Output {
+	case "", "stderr":
+		w = os.Stderr
+	case "stdout":
+		w = os.Stdout
+	default:
+		f, err := os.OpenFile(config.Output, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return fmt.Errorf("error opening log file: %v", err)
+		}
+		w = f
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch strings.ToLower(config.Format) {
+	case "", "text":
+		handler = slog.NewTextHandler(w, opts)
+	case "json":
+		handler = slog.NewJSONHandler(w, opts)
+	default:
+		return fmt.Errorf("invalid log format: %q", config.Format)
+	}
+
+	slog.SetDefault(slog.New(handler))
+
+	// The Telegram library only logs in debug mode (telegram_debug).
+	return tgbotapi.SetLogger(slog.NewLogLogger(handler, slog.LevelDebug))
+}
+
+// fatal logs msg at the error level and exits.
+func fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
@@ -1,33 +1,89 @@
 package main
 
 import (
-	"github.com/marcopaganini/pixiebot/reddit"
+	"flag"
+	"fmt"
 	"gopkg.in/telegram-bot-api.v4"
-	"log"
+	"log/slog"
+	"os"
 )
 
 func main() {
-	config, err := loadConfig()
+	authorize := flag.Bool("reddit-authorize", false, "Authorize the bot with reddit and save the refresh token.")
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "Usage: %s [flags]\n       %s audit [-chat id] [-since time] [-until time]\n", os.Args[0], os.Args[0])
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	config, err := loadConfig(*authorize)
+	if err != nil {
+		fatal("Error loading config", "error", err)
+	}
+	if err := setupLogging(config.Log); err != nil {
+		fatal("Error setting up logging", "error", err)
+	}
+
+	// One-time authorization flow (refresh_token grant).
+	if *authorize {
+		if err := redditAuthorize(config); err != nil {
+			fatal("Error authorizing with reddit", "error", err)
+		}
+		return
+	}
+
+	// Query the audit log.
+	if flag.Arg(0) == "audit" {
+		if err := runAudit(config, flag.Args()[1:]); err != nil {
+			fatal("Error reading audit log", "error", err)
+		}
+		return
+	}
+
+	audit, err = openAuditLog(config.AuditLog)
+	if err != nil {
+		fatal("Error opening audit log", "error", err)
+	}
+
+	blocklist, err = loadBlocklist()
 	if err != nil {
-		log.Fatal(err)
+		fatal("Error loading blocklist", "error", err)
 	}
 
-	// New Reddit client.
-	rclient := reddit.NewClient(config.Username, config.Password, config.ClientID, config.Secret)
+	votes, err = loadVotes(config.VoteTuning)
+	if err != nil {
+		fatal("Error loading votes", "error", err)
+	}
+
+	// Media sources used by the triggers (reddit, etc).
+	sources, err := newMediaSources(config)
+	if err != nil {
+		fatal("Error initializing media sources", "error", err)
+	}
+
+	// HTTP server for metrics and health checks.
+	if config.HTTPListen != "" {
+		serveHTTP(config.HTTPListen)
+	}
 
 	// New Bot.
 	bot, err := tgbotapi.NewBotAPI(config.Token)
 	if err != nil {
-		log.Fatalf("Error starting bot: %v", err)
+		fatal("Error starting bot", "error", err)
 	}
 
 	// run bot (this should never exit).
-	bot.Debug = true
-	log.Printf("Authorized on account %s", bot.Self.UserName)
+	bot.Debug = config.TelegramDebug
+	slog.Info("Authorized on Telegram", "account", bot.Self.UserName)
+	health.setReadyCheck(botReady(bot, sources))
+
+	if err := config.triggerConfig.resolveChannels(bot); err != nil {
+		fatal("Error resolving trigger channels", "error", err)
+	}
 
 	u := tgbotapi.NewUpdate(0)
-	u.Timeout = 60
-	updates, _ := bot.GetUpdatesChan(u)
+	u.Timeout = updatesTimeout
+	updates := getUpdatesChan(bot, u)
 
-	run(bot, updates, rclient, config.triggerConfig)
+	run(bot, updates, config, sources)
 }
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+)
+
+// Media types
+const (
+	mediaNone      = iota // 0: No usable media.
+	mediaImage     = iota // 1: An URL pointing to an image.
+	mediaFile      = iota // 2: An URL pointing to a file (usually an MP4 video).
+	mediaVideo     = iota // 3: An URL pointing to a video page (e.g. youtube).
+	mediaAnimation = iota // 4: An URL pointing to an animation (GIF or silent MP4).
+)
+
+// mediaTypeNames holds printable names for the media types.
+var mediaTypeNames = map[int]string{
+	mediaNone:      "none",
+	mediaImage:     "image",
+	mediaFile:      "file",
+	mediaVideo:     "video",
+	mediaAnimation: "animation",
+}
+
+// mediaTypeName returns a printable name for a media type.
+func mediaTypeName(t int) string {
+	if name, ok := mediaTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", t)
+}
+
+// mediaPost is a post with media returned by a MediaSource.
+type mediaPost struct {
+	// Source specific post ID (used to block posts), title and permalink
+	// (may be empty).
+	ID        string
+	Title     string
+	Permalink string
+
+	// Subreddit the post came from (reddit only).
+	Subreddit string
+
+	// Media URL and type (one of the media* constants).
+	MediaURL  string
+	MediaType int
+
+	// URL of a small preview image (empty if the post has none).
+	Thumbnail string
+
+	// Path of a local file holding the media, uploaded instead of sending
+	// MediaURL to Telegram. Never set from remote data: only sources
+	// reading from the local disk set it.
+	LocalFile string
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"log/slog"
+	"net/http"
+)
+
+// Prometheus metrics. Reddit specific metrics live in the reddit package.
+var (
+	updatesReceived = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pixiebot_updates_received_total",
+		Help: "Telegram updates received.",
+	})
+
+	triggerMatches = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixiebot_trigger_matches_total",
+		Help: "Messages matching a trigger rule (and winning the dice roll), by rule.",
+	}, []string{"rule"})
+
+	diceLost = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixiebot_dice_lost_total",
+		Help: "Messages matching a trigger rule but losing the dice roll, by rule.",
+	}, []string{"rule"})
+
+	votesReceived = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixiebot_votes_total",
+		Help: "Votes on the bot's posts, by rule and vote (up, down, withdrawn).",
+	}, []string{"rule", "vote"})
+
+	inlineQueries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "pixiebot_inline_queries_total",
+		Help: "Inline queries answered.",
+	})
+
+	sendFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixiebot_telegram_send_failures_total",
+		Help: "Failures sending media to Telegram, by handler (media type).",
+	}, []string{"handler"})
+)
+
+// newHTTPMux returns the mux used by the bot's HTTP server.
+func newHTTPMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", health.healthz)
+	mux.HandleFunc("/readyz", health.readyz)
+	return mux
+}
+
+// serveHTTP starts the bot's HTTP server on addr in the background.
+func serveHTTP(addr string) {
+	go func() {
+		slog.Info("Starting HTTP server", "address", addr)
+		if err := http.ListenAndServe(addr, newHTTPMux()); err != nil {
+			slog.Error("HTTP server stopped", "error", err)
+		}
+	}()
+}
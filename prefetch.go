@@ -0,0 +1,90 @@
+package main
+
+import (
+	"github.com/marcopaganini/pixiebot/reddit"
+	"log/slog"
+	"time"
+)
+
+const (
+	// Time to wait before trying to refill a pool after a fetch error.
+	prefetchErrorWait = time.Minute
+
+	// Time to wait between fetches returning no media.
+	prefetchNoMediaWait = 2 * time.Second
+)
+
+// prefetchKey identifies a pool by target and mode.
+type prefetchKey struct {
+	target string
+	mode   string
+}
+
+// prefetchSource wraps a MediaSource keeping a small pool of ready to send
+// posts (with media) per target and mode. Pools are refilled in the
+// background. When a pool is empty (or the target is not prefetched),
+// RandomPost falls back to a live fetch from the wrapped source.
+type prefetchSource struct {
+	src   MediaSource
+	pools map[prefetchKey]chan mediaPost
+}
+
+// newPrefetchSource returns a prefetchSource wrapping src, and starts one
+// background prefetcher per target/mode used by the triggers with the given
+// source name. Each pool holds up to size posts.
+func newPrefetchSource(src MediaSource, name string, triggers TriggerConfig, size int) *prefetchSource {
+	p := &prefetchSource{
+		src:   src,
+		pools: map[prefetchKey]chan mediaPost{},
+	}
+	for _, rule := range triggers {
+		key := prefetchKey{target: rule.target, mode: rule.mode}
+		if rule.source != name || p.pools[key] != nil {
+			continue
+		}
+		pool := make(chan mediaPost, size)
+		p.pools[key] = pool
+		go p.fill(key, pool)
+	}
+	return p
+}
+
+// fill keeps the pool full. It blocks (holding one ready post) while the
+// pool is full and fetches again as soon as a post is consumed.
+func (p *prefetchSource) fill(key prefetchKey, pool chan mediaPost) {
+	for {
+		post, err := p.src.RandomPost(key.target, key.mode)
+		if err != nil {
+			slog.Warn("Prefetch error", "target", key.target, "mode", key.mode, "error", err)
+			time.Sleep(prefetchErrorWait)
+			continue
+		}
+		if post.MediaType == mediaNone {
+			time.Sleep(prefetchNoMediaWait)
+			continue
+		}
+		pool <- post
+	}
+}
+
+// Token returns the token of the wrapped source, if it has one.
+func (p *prefetchSource) Token() (*reddit.Token, error) {
+	if ts, ok := p.src.(tokenSource); ok {
+		return ts.Token()
+	}
+	return nil, nil
+}
+
+// RandomPost returns a post from the pool for target and mode, or fetches
+// one from the wrapped source if the pool is empty.
+func (p *prefetchSource) RandomPost(target, mode string) (mediaPost, error) {
+	if pool, ok := p.pools[prefetchKey{target: target, mode: mode}]; ok {
+		select {
+		case post := <-pool:
+			return post, nil
+		default:
+			slog.Info("Prefetch pool empty, fetching live", "target", target, "mode", mode)
+		}
+	}
+	return p.src.RandomPost(target, mode)
+}
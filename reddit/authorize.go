@@ -0,0 +1,58 @@
+package reddit
+
+import (
+	"errors"
+	"net/url"
+)
+
+const (
+	// redditAuthorizeURL is the page where users authorize our app to
+	// access reddit on their behalf (authorization code flow).
+	redditAuthorizeURL = "https://www.reddit.com/api/v1/authorize"
+)
+
+// AuthorizeURL returns the URL the user must visit to authorize this app
+// using reddit's authorization code flow. After authorization, reddit
+// redirects the browser to redirectURI with the "state" and "code" query
+// parameters set. A permanent authorization (one that yields a refresh
+// token) is always requested.
+func AuthorizeURL(clientID, redirectURI, state, scope string, opts ...Option) string {
+	o := newOptions(opts...)
+
+	v := url.Values{}
+	v.Set("client_id", clientID)
+	v.Set("response_type", "code")
+	v.Set("state", state)
+	v.Set("redirect_uri", redirectURI)
+	v.Set("duration", "permanent")
+	v.Set("scope", scope)
+
+	return o.authorizeURL + "?" + v.Encode()
+}
+
+// ExchangeCode exchanges the authorization code obtained from the redirect
+// after AuthorizeURL for an access token and a refresh token. The refresh
+// token is returned and stored in the credentials, which switch to the
+// refresh_token grant from now on.
+func (c *Credentials) ExchangeCode(code, redirectURI string) (string, error) {
+	v := url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", redirectURI)
+	tok, err := c.requestToken(v)
+	if err != nil {
+		return "", err
+	}
+	if tok.RefreshToken == "" {
+		return "", errors.New("reddit did not return a refresh token")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = tok
+	c.grant = GrantRefreshToken
+	c.refreshToken = tok.RefreshToken
+	c.scheduleRefresh(tok)
+
+	return tok.RefreshToken, nil
+}
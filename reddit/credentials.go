@@ -4,11 +4,13 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"golang.org/x/sync/singleflight"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -16,6 +18,33 @@ const (
 	// redditAuthURL contains the URL for reddit authorization
 	// (exchanging user/password for access-token).
 	redditAuthURL = "https://www.reddit.com/api/v1/access_token"
+
+	// installedClientGrant is the grant_type URI reddit expects for
+	// application-only OAuth on installed (non-confidential) clients.
+	installedClientGrant = "https://oauth.reddit.com/grants/installed_client"
+
+	// doNotTrackDeviceID is used as the device_id for the installed_client
+	// grant when none is configured.
+	doNotTrackDeviceID = "DO_NOT_TRACK_THIS_DEVICE"
+
+	// refreshAhead defines how long before expiration the token is
+	// refreshed in the background.
+	refreshAhead = 5 * time.Minute
+)
+
+// OAuth grant types supported by Credentials.
+const (
+	// GrantPassword authenticates as a reddit user (script apps).
+	GrantPassword = "password"
+	// GrantClientCredentials is the application-only grant for confidential
+	// clients (requires client ID and secret, but no reddit account).
+	GrantClientCredentials = "client_credentials"
+	// GrantInstalledClient is the application-only grant for installed
+	// clients (requires client ID and a device ID, but no secret).
+	GrantInstalledClient = "installed_client"
+	// GrantRefreshToken uses a refresh token obtained previously through
+	// the authorization code flow (see AuthorizeURL and ExchangeCode).
+	GrantRefreshToken = "refresh_token"
 )
 
 // Token holds the Oauth2 token from Reddit.
@@ -25,30 +54,62 @@ type Token struct {
 	ExpiresIn   int    `json:"expires_in"`
 	Scope       string `json:"scope"`
 
+	// Only returned by the authorization code flow.
+	RefreshToken string `json:"refresh_token"`
+
+	// Set by reddit when the request fails (even with HTTP 200).
+	Error string `json:"error"`
+
 	// Token creation time.
 	ctime time.Time
 }
 
 // Credentials holds all state require to authenticate a reddit request.
+// It is safe for concurrent use.
 type Credentials struct {
+	// mu protects token, grant and refreshToken. Concurrent refreshes are
+	// collapsed into a single request by sf, and timer refreshes the token
+	// in the background shortly before it expires.
+	mu    sync.Mutex
+	sf    singleflight.Group
+	timer *time.Timer
+
 	token        *Token
 	username     string
 	password     string
 	clientID     string
 	clientSecret string
 
-	// Reddit auth URL.
-	tokenURL string
+	// OAuth grant type, device ID (installed_client grant only) and
+	// refresh token (refresh_token grant only).
+	grant        string
+	deviceID     string
+	refreshToken string
+
+	// Reddit auth URL, user agent and HTTP client.
+	tokenURL   string
+	userAgent  string
+	httpClient *http.Client
+
+	// Rate limiter shared with the client using these credentials.
+	limiter *rateLimiter
 }
 
 // NewCredentials returns a pointer to a new Credentials object.
-func NewCredentials(username, password, clientID, clientSecret string) *Credentials {
+func NewCredentials(username, password, clientID, clientSecret string, opts ...Option) *Credentials {
+	o := newOptions(opts...)
 	return &Credentials{
 		username:     username,
 		password:     password,
 		clientID:     clientID,
 		clientSecret: clientSecret,
-		tokenURL:     redditAuthURL,
+		grant:        o.grant,
+		deviceID:     o.deviceID,
+		refreshToken: o.refreshToken,
+		tokenURL:     o.tokenURL,
+		userAgent:    o.userAgent,
+		httpClient:   o.httpClient,
+		limiter:      newRateLimiter(),
 	}
 }
 
@@ -59,78 +120,153 @@ func (c *Credentials) RefreshToken() error {
 	}
 
 	// Do we need a new token?
-	if validToken(c.token) {
+	c.mu.Lock()
+	valid := validToken(c.token)
+	c.mu.Unlock()
+	if valid {
 		return nil
 	}
 
-	client := &http.Client{}
+	// Concurrent callers share the same refresh request.
+	_, err, _ := c.sf.Do("token", func() (interface{}, error) {
+		return nil, c.refresh()
+	})
+	return err
+}
 
-	// To create a new "Reddit App", visit https://www.reddit.com/prefs/apps
-	// username: reddit username.
-	// password: reddit password.
-	v := url.Values{}
-	v.Set("grant_type", "password")
-	v.Set("username", c.username)
-	v.Set("password", c.password)
+// refresh unconditionally fetches a new token and schedules the next
+// background refresh.
+func (c *Credentials) refresh() error {
+	c.mu.Lock()
+	v, err := c.grantValues()
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
 
-	formdata := v.Encode()
+	tok, err := c.requestToken(v)
+	if err != nil {
+		return err
+	}
 
-	var try uint
-	var resp *http.Response
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.token = tok
+	c.scheduleRefresh(tok)
 
-	for try = 0; try < authTries; try++ {
-		req, err := http.NewRequest("POST", redditAuthURL, strings.NewReader(formdata))
-		if err != nil {
-			return fmt.Errorf("error creating HTTP request: %v", err)
-		}
-		req.SetBasicAuth(c.clientID, c.clientSecret)
-		req.Header.Add("User-agent", userAgent)
-		resp, err = client.Do(req)
+	return nil
+}
+
+// scheduleRefresh arranges for the token to be refreshed in the background
+// shortly before it expires. Must be called with c.mu held.
+func (c *Credentials) scheduleRefresh(tok *Token) {
+	lifetime := time.Duration(tok.ExpiresIn) * time.Second
+	if lifetime <= 0 {
+		return
+	}
+	// Short lived tokens are refreshed halfway through their lifetime.
+	ahead := refreshAhead
+	if ahead > lifetime/2 {
+		ahead = lifetime / 2
+	}
 
+	if c.timer != nil {
+		c.timer.Stop()
+	}
+	c.timer = time.AfterFunc(time.Until(tok.ctime.Add(lifetime-ahead)), func() {
+		_, err, _ := c.sf.Do("token", func() (interface{}, error) {
+			return nil, c.refresh()
+		})
 		if err != nil {
-			return fmt.Errorf("token request error: %v", err)
+			slog.Error("Background token refresh failed", "error", err)
 		}
-		defer resp.Body.Close()
+	})
+}
 
-		// All good?
-		if resp.StatusCode == http.StatusOK {
-			break
-		}
+// requestToken posts the form values in v to the token URL and returns the
+// decoded token.
+func (c *Credentials) requestToken(v url.Values) (*Token, error) {
+	formdata := v.Encode()
 
-		// Overloaded?
-		if resp.StatusCode == http.StatusTooManyRequests {
-			d := time.Duration(1<<try) * time.Second
-			log.Printf("Server busy. Will retry in %v", d)
-			time.Sleep(d)
-			continue
+	resp, err := do(c.httpClient, c.limiter, func() (*http.Request, error) {
+		req, err := http.NewRequest("POST", c.tokenURL, strings.NewReader(formdata))
+		if err != nil {
+			return nil, err
 		}
-
-		// Anything else == error
-		return fmt.Errorf("token request error: http %v", resp.StatusCode)
+		req.SetBasicAuth(c.clientID, c.clientSecret)
+		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Add("User-agent", c.userAgent)
+		return req, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("token request error: %v", err)
 	}
+	defer resp.Body.Close()
 
-	if try == authTries {
-		return fmt.Errorf("unable to authenticate (server overloaded)")
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("token request error: http %v", resp.StatusCode)
 	}
 
 	buf, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return fmt.Errorf("unable to read token request response: %v", err)
+		return nil, fmt.Errorf("unable to read token request response: %v", err)
+	}
+	tok := &Token{}
+	if err := json.Unmarshal(buf, tok); err != nil {
+		return nil, fmt.Errorf("unable to decode reddit auth token: %v", err)
 	}
-	if err := json.Unmarshal(buf, &c.token); err != nil {
-		return fmt.Errorf("unable to decode reddit auth token: %v", err)
+	// Reddit returns HTTP 200 with an "error" field on failures.
+	if tok.Error != "" {
+		return nil, fmt.Errorf("token request error: %s", tok.Error)
 	}
 	// Set token last updated time.
-	c.token.ctime = time.Now()
+	tok.ctime = time.Now()
 
-	return nil
+	return tok, nil
+}
+
+// grantValues returns the form values used to request a new token using
+// the configured grant type. Must be called with c.mu held.
+func (c *Credentials) grantValues() (url.Values, error) {
+	v := url.Values{}
+
+	// To create a new "Reddit App", visit https://www.reddit.com/prefs/apps
+	switch c.grant {
+	case GrantPassword, "":
+		// username: reddit username.
+		// password: reddit password.
+		v.Set("grant_type", GrantPassword)
+		v.Set("username", c.username)
+		v.Set("password", c.password)
+	case GrantClientCredentials:
+		v.Set("grant_type", GrantClientCredentials)
+	case GrantInstalledClient:
+		deviceID := c.deviceID
+		if deviceID == "" {
+			deviceID = doNotTrackDeviceID
+		}
+		v.Set("grant_type", installedClientGrant)
+		v.Set("device_id", deviceID)
+	case GrantRefreshToken:
+		if c.refreshToken == "" {
+			return nil, errors.New("no refresh token available (authorize the app first)")
+		}
+		v.Set("grant_type", GrantRefreshToken)
+		v.Set("refresh_token", c.refreshToken)
+	default:
+		return nil, fmt.Errorf("unknown grant type: %q", c.grant)
+	}
+	return v, nil
 }
 
 // Token returns the latest token (or triggers a token fetch, if needed).
+// The returned token must not be modified.
 func (c *Credentials) Token() (*Token, error) {
 	if err := c.RefreshToken(); err != nil {
 		return nil, err
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.token, nil
 }
 
@@ -148,7 +284,7 @@ func validToken(token *Token) bool {
 
 	now := time.Now()
 	if now.Before(exp) {
-		log.Printf("Token still valid: now: %v, expires: %v", time.Now(), exp)
+		slog.Debug("Token still valid", "expires", exp)
 		return true
 	}
 	return false
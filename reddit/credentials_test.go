@@ -0,0 +1,92 @@
+package reddit
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tokenServer starts an httptest token endpoint returning tokens that expire
+// in expiresIn seconds, and returns it with the request counter. Requests
+// are slowed down a bit so concurrent callers overlap.
+func tokenServer(t *testing.T, expiresIn int) (*httptest.Server, *int32) {
+	t.Helper()
+	var count int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&count, 1)
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprintf(w, `{"access_token":"tok%d","token_type":"bearer","expires_in":%d,"scope":"*"}`, n, expiresIn)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, &count
+}
+
+func TestCredentialsConcurrentToken(t *testing.T) {
+	srv, count := tokenServer(t, 3600)
+	c := NewCredentials("user", "pass", "id", "secret", WithTokenURL(srv.URL))
+
+	const callers = 50
+	var wg sync.WaitGroup
+	tokens := make([]string, callers)
+	errs := make([]error, callers)
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tok, err := c.Token()
+			errs[i] = err
+			if err == nil {
+				tokens[i] = tok.AccessToken
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := range tokens {
+		if errs[i] != nil {
+			t.Fatalf("Token: %v", errs[i])
+		}
+		if tokens[i] != "tok1" {
+			t.Errorf("caller %d: got token %q, want %q", i, tokens[i], "tok1")
+		}
+	}
+	if n := atomic.LoadInt32(count); n != 1 {
+		t.Errorf("got %d token requests, want 1", n)
+	}
+}
+
+func TestCredentialsBackgroundRefresh(t *testing.T) {
+	// Tokens living 2 seconds are refreshed in the background halfway
+	// through their lifetime.
+	srv, count := tokenServer(t, 2)
+	c := NewCredentials("user", "pass", "id", "secret", WithTokenURL(srv.URL))
+	if err := c.RefreshToken(); err != nil {
+		t.Fatalf("RefreshToken: %v", err)
+	}
+
+	// Wait for the refreshed token without calling Token (which would
+	// fetch one itself).
+	current := func() string {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return c.token.AccessToken
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for current() == "tok1" && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+	if tok := current(); tok != "tok2" {
+		t.Errorf("got token %q, want %q from the background refresh", tok, "tok2")
+	}
+
+	c.mu.Lock()
+	c.timer.Stop()
+	c.mu.Unlock()
+	if n := atomic.LoadInt32(count); n != 2 {
+		t.Errorf("got %d token requests, want 2", n)
+	}
+}
@@ -0,0 +1,155 @@
+package reddit
+
+import (
+	"fmt"
+	"github.com/buger/jsonparser"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ModeRandom fetches a random post using reddit's /random endpoint.
+	ModeRandom = "random"
+
+	// listingPath contains the format for the path used to fetch a
+	// subreddit listing (subreddit, sort and query string).
+	listingPath = "/r/%s/%s.json?%s"
+
+	// Number of posts fetched per listing (reddit's maximum).
+	listingLimit = 100
+
+	// Default time to keep listings in the cache.
+	defaultListingTTL = 10 * time.Minute
+)
+
+// Listing sorts and whether they accept a time window (as in "top:week").
+var listingSorts = map[string]bool{
+	"hot":           false,
+	"new":           false,
+	"rising":        false,
+	"top":           true,
+	"controversial": true,
+}
+
+// Valid time windows for the sorts above.
+var listingWindows = map[string]bool{
+	"hour":  true,
+	"day":   true,
+	"week":  true,
+	"month": true,
+	"year":  true,
+	"all":   true,
+}
+
+// listingCache holds the posts with media from a listing and the time of
+// the fetch.
+type listingCache struct {
+	posts   []Post
+	fetched time.Time
+}
+
+// listings caches subreddit listings by subreddit and mode.
+type listings struct {
+	mu    sync.Mutex
+	ttl   time.Duration
+	cache map[string]listingCache
+}
+
+// ValidMode returns an error if mode is not a valid fetch mode. Valid modes
+// are "random", "hot", "new", "rising", and "top" or "controversial" with an
+// optional time window (e.g. "top:week"). An empty mode means "random".
+func ValidMode(mode string) error {
+	_, _, err := parseMode(mode)
+	return err
+}
+
+// parseMode splits mode into sort and time window.
+func parseMode(mode string) (string, string, error) {
+	if mode == "" || mode == ModeRandom {
+		return ModeRandom, "", nil
+	}
+	sort, window := mode, ""
+	if i := strings.Index(mode, ":"); i >= 0 {
+		sort, window = mode[:i], mode[i+1:]
+	}
+	hasWindow, ok := listingSorts[sort]
+	if !ok {
+		return "", "", fmt.Errorf("invalid mode: %q", mode)
+	}
+	if window != "" && (!hasWindow || !listingWindows[window]) {
+		return "", "", fmt.Errorf("invalid time window in mode: %q", mode)
+	}
+	return sort, window, nil
+}
+
+// listing returns the posts with media from the subreddit listing for mode.
+// Listings are cached for the configured TTL.
+func (c *Client) listing(subreddit, mode string) ([]Post, error) {
+	key := subreddit + "/" + mode
+
+	c.listings.mu.Lock()
+	cached, ok := c.listings.cache[key]
+	c.listings.mu.Unlock()
+	if ok && time.Since(cached.fetched) < c.listings.ttl {
+		return cached.posts, nil
+	}
+
+	sort, window, err := parseMode(mode)
+	if err != nil {
+		return nil, err
+	}
+	query := fmt.Sprintf("limit=%d&raw_json=1", listingLimit)
+	if window != "" {
+		query += "&t=" + window
+	}
+
+	body, err := c.get(fmt.Sprintf(c.baseURL+listingPath, subreddit, sort, query))
+	if err != nil {
+		return nil, err
+	}
+	posts, err := listingPosts(body)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Fetched listing", "subreddit", subreddit, "mode", mode, "posts", len(posts))
+
+	c.listings.mu.Lock()
+	c.listings.cache[key] = listingCache{posts: posts, fetched: time.Now()}
+	c.listings.mu.Unlock()
+
+	return posts, nil
+}
+
+// listingPosts returns all posts with media in a listing, including posts
+// linking to hosts handled by a resolver (resolved once picked).
+func listingPosts(data []byte) ([]Post, error) {
+	children, _, _, err := jsonparser.Get(data, "data", "children")
+	if err != nil {
+		return nil, fmt.Errorf("error decoding listing: %v", err)
+	}
+
+	var posts []Post
+	_, err = jsonparser.ArrayEach(children, func(child []byte, _ jsonparser.ValueType, _ int, err error) {
+		if err != nil {
+			return
+		}
+		rdata, _, _, err := jsonparser.Get(child, "data")
+		if err != nil {
+			return
+		}
+		post, err := parsePost(rdata)
+		if err != nil {
+			return
+		}
+		if r, _ := findResolver(post.URL); post.MediaType == MediaNone && r == nil {
+			return
+		}
+		posts = append(posts, post)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error decoding listing children: %v", err)
+	}
+	return posts, nil
+}
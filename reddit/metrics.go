@@ -0,0 +1,31 @@
+package reddit
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Prometheus metrics. These are registered in the default registry and
+// exposed by whoever serves it (see the "http_listen" option in pixiebot).
+var (
+	// Latency of each request (attempt) to reddit, including retries.
+	requestDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "pixiebot_reddit_request_duration_seconds",
+		Help:    "Latency of HTTP requests to reddit.",
+		Buckets: prometheus.DefBuckets,
+	})
+
+	// Failed requests to reddit, by HTTP status code ("error" when the
+	// request didn't get a response at all).
+	requestErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixiebot_reddit_request_errors_total",
+		Help: "Failed HTTP requests to reddit, by status code.",
+	}, []string{"code"})
+
+	// Media types of the posts returned by RandomPost (after resolving
+	// external hosts), by type name (see MediaTypeName).
+	mediaTypes = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "pixiebot_reddit_media_types_total",
+		Help: "Media types of the reddit posts picked for sending.",
+	}, []string{"type"})
+)
@@ -0,0 +1,144 @@
+package reddit
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	// defaultBaseURL is the base for all OAuth enabled reddit API requests.
+	defaultBaseURL = "https://oauth.reddit.com"
+
+	// defaultTimeout is the timeout for each HTTP request (to reddit and
+	// to the third party APIs used by resolvers).
+	defaultTimeout = 30 * time.Second
+)
+
+// Option configures a Client or Credentials object.
+type Option func(*options)
+
+// options holds the settings changeable via Option.
+type options struct {
+	baseURL       string
+	tokenURL      string
+	authorizeURL  string
+	userAgent     string
+	httpClient    *http.Client
+	grant         string
+	deviceID      string
+	refreshToken  string
+	listingTTL    time.Duration
+	imgurClientID string
+
+	previewMaxSize  int64
+	previewMaxBytes int64
+}
+
+// newOptions returns the default options modified by opts.
+func newOptions(opts ...Option) options {
+	o := options{
+		baseURL:      defaultBaseURL,
+		tokenURL:     redditAuthURL,
+		authorizeURL: redditAuthorizeURL,
+		userAgent:    userAgent,
+		httpClient:   &http.Client{Timeout: defaultTimeout},
+		grant:        GrantPassword,
+		listingTTL:   defaultListingTTL,
+
+		previewMaxSize:  DefaultPreviewMaxSize,
+		previewMaxBytes: DefaultPreviewMaxBytes,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithBaseURL sets the base URL for reddit API requests (default:
+// https://oauth.reddit.com).
+func WithBaseURL(u string) Option {
+	return func(o *options) {
+		o.baseURL = strings.TrimSuffix(u, "/")
+	}
+}
+
+// WithTokenURL sets the URL used to obtain access tokens.
+func WithTokenURL(u string) Option {
+	return func(o *options) {
+		o.tokenURL = u
+	}
+}
+
+// WithAuthorizeURL sets the URL of the authorization page returned by
+// AuthorizeURL.
+func WithAuthorizeURL(u string) Option {
+	return func(o *options) {
+		o.authorizeURL = u
+	}
+}
+
+// WithUserAgent sets the User-Agent header sent with every request.
+func WithUserAgent(ua string) Option {
+	return func(o *options) {
+		o.userAgent = ua
+	}
+}
+
+// WithHTTPClient sets the http.Client used for all requests. The client
+// should have a timeout, as requests are made while the bot handles
+// messages.
+func WithHTTPClient(c *http.Client) Option {
+	return func(o *options) {
+		o.httpClient = c
+	}
+}
+
+// WithGrant sets the OAuth grant type used to obtain access tokens. Valid
+// values are GrantPassword (default), GrantClientCredentials,
+// GrantInstalledClient and GrantRefreshToken.
+func WithGrant(grant string) Option {
+	return func(o *options) {
+		o.grant = grant
+	}
+}
+
+// WithDeviceID sets the device ID sent with the installed_client grant.
+func WithDeviceID(id string) Option {
+	return func(o *options) {
+		o.deviceID = id
+	}
+}
+
+// WithRefreshToken sets the refresh token used by the refresh_token grant.
+func WithRefreshToken(tok string) Option {
+	return func(o *options) {
+		o.refreshToken = tok
+	}
+}
+
+// WithListingTTL sets how long subreddit listings are cached.
+func WithListingTTL(d time.Duration) Option {
+	return func(o *options) {
+		o.listingTTL = d
+	}
+}
+
+// WithImgurClientID sets the imgur API client ID used to resolve imgur
+// albums. Albums are not resolved without it.
+func WithImgurClientID(id string) Option {
+	return func(o *options) {
+		o.imgurClientID = id
+	}
+}
+
+// WithPreviewLimits sets the limits for preview images: the largest preview
+// rendition with width + height up to maxSize pixels and a file size up to
+// maxBytes is used. Zero disables the respective limit. Defaults are
+// DefaultPreviewMaxSize and DefaultPreviewMaxBytes.
+func WithPreviewLimits(maxSize, maxBytes int64) Option {
+	return func(o *options) {
+		o.previewMaxSize = maxSize
+		o.previewMaxBytes = maxBytes
+	}
+}
@@ -0,0 +1,104 @@
+package reddit
+
+import (
+	"fmt"
+	"github.com/buger/jsonparser"
+	"html"
+	"log/slog"
+	"net/http"
+	"sort"
+)
+
+const (
+	// DefaultPreviewMaxSize and DefaultPreviewMaxBytes are the default
+	// preview limits, matching Telegram's limits for photos sent by URL:
+	// width + height must not exceed 10000 pixels and the file must be at
+	// most 5MB.
+	DefaultPreviewMaxSize  = 10000
+	DefaultPreviewMaxBytes = 5 * 1024 * 1024
+)
+
+// preview holds one rendition of a preview image.
+type preview struct {
+	url    string
+	width  int64
+	height int64
+}
+
+// previewImages returns the source and all resolutions of the first preview
+// image in the post, largest first.
+func previewImages(rdata []byte) []preview {
+	img, _, _, err := jsonparser.Get(rdata, "preview", "images", "[0]")
+	if err != nil {
+		return nil
+	}
+
+	var previews []preview
+	add := func(value []byte) {
+		u, err := jsonparser.GetString(value, "url")
+		if err != nil {
+			return
+		}
+		w, _ := jsonparser.GetInt(value, "width")
+		h, _ := jsonparser.GetInt(value, "height")
+		previews = append(previews, preview{url: html.UnescapeString(u), width: w, height: h})
+	}
+
+	if src, _, _, err := jsonparser.Get(img, "source"); err == nil {
+		add(src)
+	}
+	jsonparser.ArrayEach(img, func(value []byte, _ jsonparser.ValueType, _ int, _ error) {
+		add(value)
+	}, "resolutions")
+
+	sort.SliceStable(previews, func(i, j int) bool {
+		return previews[i].width*previews[i].height > previews[j].width*previews[j].height
+	})
+	return previews
+}
+
+// fitPreview replaces the media URL of posts using a preview image with the
+// largest rendition within the configured limits: width + height must not
+// exceed maxSize and the file size (as reported by a HEAD request) must not
+// exceed maxBytes. The smallest rendition is used if none fits.
+func (c *Client) fitPreview(post *Post) {
+	if post.MediaType != MediaImageURL || len(post.previews) == 0 {
+		return
+	}
+
+	for _, p := range post.previews {
+		if c.previewMaxSize > 0 && p.width+p.height > c.previewMaxSize {
+			continue
+		}
+		if c.previewMaxBytes > 0 {
+			size, err := c.contentLength(p.url)
+			if err != nil {
+				slog.Warn("Unable to get preview size (using it anyway)", "url", p.url, "error", err)
+			} else if size > c.previewMaxBytes {
+				continue
+			}
+		}
+		post.MediaURL = p.url
+		return
+	}
+	post.MediaURL = post.previews[len(post.previews)-1].url
+}
+
+// contentLength returns the size of the resource at u using a HEAD request,
+// or -1 if the server doesn't report it.
+func (c *Client) contentLength(u string) (int64, error) {
+	req, err := http.NewRequest("HEAD", u, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Add("User-agent", c.userAgent)
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("HEAD returned code: %v", resp.StatusCode)
+	}
+	return resp.ContentLength, nil
+}
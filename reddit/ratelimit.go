@@ -0,0 +1,179 @@
+package reddit
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// requestTries defines how many times a request is attempted when
+	// reddit returns 429 (Too Many Requests) or a 5xx error.
+	requestTries = 4
+
+	// minRemaining is the number of requests we keep in reserve. Once the
+	// remaining quota drops below this, requests are delayed until reset.
+	minRemaining = 2
+
+	// maxRateLimitWait is the longest we're willing to wait for the rate
+	// limit window to reset. Requests needing more than that are shed.
+	maxRateLimitWait = 30 * time.Second
+)
+
+// ErrRateLimited is returned when a request is shed because the rate limit
+// window would take too long to reset.
+var ErrRateLimited = errors.New("reddit rate limit reached")
+
+// rateLimiter tracks reddit's X-Ratelimit-* response headers across all
+// requests and delays (or sheds) requests before the limit is reached.
+type rateLimiter struct {
+	// turn serializes callers of wait, so callers waiting for the window
+	// to reset go in order. mu protects the fields below and is never held
+	// while sleeping, so responses can update the state meanwhile.
+	turn chan struct{}
+	mu   sync.Mutex
+
+	// Requests remaining in the current window and the time the window
+	// resets. known is false until we see the headers for the first time.
+	remaining float64
+	reset     time.Time
+	known     bool
+
+	maxWait time.Duration
+}
+
+// newRateLimiter returns a new rateLimiter.
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{turn: make(chan struct{}, 1), maxWait: maxRateLimitWait}
+}
+
+// wait blocks until it's safe to issue a new request, or returns
+// ErrRateLimited if that would take longer than the maximum wait time.
+func (r *rateLimiter) wait() error {
+	// Other callers queue behind us while we sleep.
+	r.turn <- struct{}{}
+	defer func() { <-r.turn }()
+
+	d, err := r.reserve()
+	if err != nil || d == 0 {
+		return err
+	}
+	slog.Warn("Rate limit almost reached, waiting", "wait", d)
+	time.Sleep(d)
+	return nil
+}
+
+// reserve reserves one request from the quota and returns zero, or returns
+// how long to wait for the window to reset if the quota is (almost) used up.
+func (r *rateLimiter) reserve() (time.Duration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !r.known {
+		return 0, nil
+	}
+
+	now := time.Now()
+	if !now.Before(r.reset) {
+		// Window reset. We don't know the new quota until the next response.
+		r.known = false
+		return 0, nil
+	}
+
+	if r.remaining < minRemaining {
+		d := r.reset.Sub(now)
+		if d > r.maxWait {
+			return 0, fmt.Errorf("%w (resets in %v)", ErrRateLimited, d.Round(time.Second))
+		}
+		// The window will have reset once we're done waiting.
+		r.known = false
+		return d, nil
+	}
+
+	// Reserve one request from the quota so concurrent callers
+	// don't all rush in on the same number.
+	r.remaining--
+	return 0, nil
+}
+
+// update records the rate limit state from the headers in resp.
+func (r *rateLimiter) update(resp *http.Response) {
+	remaining, err := strconv.ParseFloat(resp.Header.Get("X-Ratelimit-Remaining"), 64)
+	if err != nil {
+		return
+	}
+	reset, err := strconv.ParseFloat(resp.Header.Get("X-Ratelimit-Reset"), 64)
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.remaining = remaining
+	r.reset = time.Now().Add(time.Duration(reset * float64(time.Second)))
+	r.known = true
+}
+
+// retryable returns true if the HTTP status code is worth retrying.
+func retryable(code int) bool {
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+// backoff returns the time to wait before the next attempt. Retry-After is
+// honored if present. Otherwise, use exponential backoff with jitter.
+func backoff(try int, resp *http.Response) time.Duration {
+	if resp != nil {
+		if secs, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && secs > 0 {
+			return time.Duration(secs) * time.Second
+		}
+	}
+	d := time.Duration(1<<uint(try)) * time.Second
+	return d/2 + time.Duration(rand.Int63n(int64(d)))
+}
+
+// do sends the request created by newReq, waiting on the rate limiter
+// before each attempt and retrying with jittered backoff on 429 and 5xx
+// errors. newReq is called once per attempt since request bodies can't be
+// reused. The caller must close the body of the returned response.
+func do(client *http.Client, limiter *rateLimiter, newReq func() (*http.Request, error)) (*http.Response, error) {
+	var resp *http.Response
+
+	for try := 0; try < requestTries; try++ {
+		if err := limiter.wait(); err != nil {
+			return nil, err
+		}
+
+		req, err := newReq()
+		if err != nil {
+			return nil, fmt.Errorf("error creating HTTP request: %v", err)
+		}
+		start := time.Now()
+		resp, err = client.Do(req)
+		requestDuration.Observe(time.Since(start).Seconds())
+		if err != nil {
+			requestErrors.WithLabelValues("error").Inc()
+			return nil, err
+		}
+		limiter.update(resp)
+		if resp.StatusCode >= http.StatusBadRequest {
+			requestErrors.WithLabelValues(strconv.Itoa(resp.StatusCode)).Inc()
+		}
+
+		if !retryable(resp.StatusCode) {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		if try < requestTries-1 {
+			d := backoff(try, resp)
+			slog.Warn("Reddit request failed, will retry", "status", resp.StatusCode, "path", req.URL.Path, "wait", d)
+			time.Sleep(d)
+		}
+	}
+	return nil, fmt.Errorf("giving up after %d tries (last HTTP status: %d)", requestTries, resp.StatusCode)
+}
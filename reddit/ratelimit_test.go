@@ -0,0 +1,67 @@
+package reddit
+
+import (
+	"errors"
+	"net/http"
+	"testing"
+	"time"
+)
+
+// rateLimitResponse returns a response with the given rate limit headers.
+func rateLimitResponse(remaining, reset string) *http.Response {
+	return &http.Response{Header: http.Header{
+		"X-Ratelimit-Remaining": {remaining},
+		"X-Ratelimit-Reset":     {reset},
+	}}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	r := newRateLimiter()
+	r.update(rateLimitResponse("0", "0.3"))
+
+	done := make(chan error)
+	start := time.Now()
+	go func() { done <- r.wait() }()
+
+	// Responses must not be blocked by a caller waiting for the window to
+	// reset.
+	time.Sleep(50 * time.Millisecond)
+	updated := make(chan struct{})
+	go func() {
+		r.update(rateLimitResponse("100", "600"))
+		close(updated)
+	}()
+	select {
+	case <-updated:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("update blocked while wait is sleeping")
+	}
+
+	if err := <-done; err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	if d := time.Since(start); d < 250*time.Millisecond {
+		t.Errorf("wait returned after %v, want about 300ms", d)
+	}
+
+	// The quota from the latest response is used.
+	if err := r.wait(); err != nil {
+		t.Fatalf("wait: %v", err)
+	}
+	r.mu.Lock()
+	remaining := r.remaining
+	r.mu.Unlock()
+	if remaining != 99 {
+		t.Errorf("got %v requests remaining, want 99", remaining)
+	}
+}
+
+func TestRateLimiterShed(t *testing.T) {
+	r := newRateLimiter()
+	r.maxWait = time.Second
+	r.update(rateLimitResponse("0", "60"))
+
+	if err := r.wait(); !errors.Is(err, ErrRateLimited) {
+		t.Errorf("got error %v, want %v", err, ErrRateLimited)
+	}
+}
@@ -6,40 +6,73 @@ import (
 	"github.com/buger/jsonparser"
 	"html"
 	"io/ioutil"
-	"log"
+	"log/slog"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"strings"
 )
 
 const (
-	// redditRandomArticleURL contains the default format for a reddit URL
-	// used to fetch a random article from a subreddit.
-	randomArticleURLFormat = "http://oauth.reddit.com/r/%s/random.json"
+	// randomArticlePath contains the format for the path used to fetch a
+	// random article from a subreddit (relative to the base URL).
+	randomArticlePath = "/r/%s/random.json"
 
 	// Custom user-agent is recommended by reddit.
 	// Most default UAs are heavily throttled.
 	userAgent = "github.com/marcopaganini/pixiebot"
-
-	// authTries defines how many times authentication is
-	// attempted before giving up.
-	authTries = 5
 )
 
 // Media types
 const (
-	MediaNone     = iota // 0: No usable media.
-	MediaImageURL = iota // 1: An URL pointing to an image.
-	MediaFileURL  = iota // 2: An URL pointing to a file.
-	MediaVideoURL = iota // 3: An URL pointing to a video.
+	MediaNone         = iota // 0: No usable media.
+	MediaImageURL     = iota // 1: An URL pointing to an image.
+	MediaFileURL      = iota // 2: An URL pointing to a file.
+	MediaVideoURL     = iota // 3: An URL pointing to a video.
+	MediaAnimationURL = iota // 4: An URL pointing to an animation (GIF or silent MP4).
 )
 
+// mediaTypeNames holds printable names for the media types.
+var mediaTypeNames = map[int]string{
+	MediaNone:         "none",
+	MediaImageURL:     "image",
+	MediaFileURL:      "file",
+	MediaVideoURL:     "video",
+	MediaAnimationURL: "animation",
+}
+
+// MediaTypeName returns a printable name for a media type.
+func MediaTypeName(t int) string {
+	if name, ok := mediaTypeNames[t]; ok {
+		return name
+	}
+	return fmt.Sprintf("unknown(%d)", t)
+}
+
 // Client holds state about a Reddit client
 type Client struct {
 	cred CredentialsInterface
 
 	// Format of the random article URL (expands subreddit).
 	randomArticleURL string
+
+	// Base URL for API requests, user agent and HTTP client.
+	baseURL    string
+	userAgent  string
+	httpClient *http.Client
+
+	// Rate limiter shared by all requests to reddit.
+	limiter *rateLimiter
+
+	// Cached subreddit listings.
+	listings *listings
+
+	// Imgur API client ID (used to resolve imgur albums).
+	imgurClientID string
+
+	// Limits for preview images (width + height and file size).
+	previewMaxSize  int64
+	previewMaxBytes int64
 }
 
 // CredentialsInterface defines the interface between the client and
@@ -49,88 +82,171 @@ type CredentialsInterface interface {
 	Token() (*Token, error)
 }
 
-// NewClient creates a new Reddit client using the passed credentials.
-func NewClient(username, password, clientID, clientSecret string) *Client {
+// NewClient creates a new Reddit client using the passed credentials. The
+// same options are used to create the client credentials.
+func NewClient(username, password, clientID, clientSecret string, opts ...Option) *Client {
+	o := newOptions(opts...)
+
+	// Credentials and client share the same rate limiter.
+	cred := NewCredentials(username, password, clientID, clientSecret, opts...)
 	return &Client{
-		cred:             NewCredentials(username, password, clientID, clientSecret),
-		randomArticleURL: randomArticleURLFormat,
+		cred:             cred,
+		randomArticleURL: o.baseURL + randomArticlePath,
+		baseURL:          o.baseURL,
+		userAgent:        o.userAgent,
+		httpClient:       o.httpClient,
+		limiter:          cred.limiter,
+		listings:         &listings{ttl: o.listingTTL, cache: map[string]listingCache{}},
+		imgurClientID:    o.imgurClientID,
+		previewMaxSize:   o.previewMaxSize,
+		previewMaxBytes:  o.previewMaxBytes,
 	}
 }
 
+// Post holds a reddit post and the media it contains.
+type Post struct {
+	ID        string
+	Subreddit string
+	Title     string
+	Permalink string
+
+	// URL the post links to (may be the same as the media URL).
+	URL string
+
+	// Media URL and type (one of the Media* constants).
+	MediaURL  string
+	MediaType int
+
+	// URL of a small preview image (empty if the post has none).
+	Thumbnail string
+
+	// Raw "data" object of the post (used by resolvers).
+	data []byte
+
+	// Preview image renditions, largest first (only set when the media
+	// URL points to the preview image).
+	previews []preview
+}
+
+// Token returns the client's OAuth token, fetching a new one if needed.
+func (c *Client) Token() (*Token, error) {
+	return c.cred.Token()
+}
+
 // RandomMediaURL returns the URL containing a random media from a given
 // subreddit. The type specifies the type of media being returned (usually an
 // URL pointing to an image or to a video). Returns the type empty string with
 // type mediaNone if the random article does not contain any pictures.
 func (c *Client) RandomMediaURL(subreddit string) (string, int, error) {
-	// Refresh token, if needed.
-	if err := c.cred.RefreshToken(); err != nil {
-		return "", MediaNone, err
-	}
+	post, err := c.RandomPost(subreddit, ModeRandom)
+	return post.MediaURL, post.MediaType, err
+}
 
-	// Create request to the OAuth enabled URL with all tokens.
-	redditURL := fmt.Sprintf(c.randomArticleURL, subreddit)
+// RandomPost returns a random post from subreddit. With ModeRandom, reddit
+// picks the post (and it may not contain any media). All other modes fetch
+// a listing (e.g. "hot", "top:week") and pick a random post with media from
+// it. The post has MediaType set to MediaNone if no media is found.
+func (c *Client) RandomPost(subreddit, mode string) (Post, error) {
+	if mode == "" || mode == ModeRandom {
+		body, err := c.get(fmt.Sprintf(c.randomArticleURL, subreddit))
+		if err != nil {
+			return Post{}, err
+		}
+		post, err := randomPost(body)
+		if err != nil {
+			return Post{}, err
+		}
+		return c.finishPost(post), nil
+	}
 
-	req, err := http.NewRequest("GET", redditURL, nil)
+	posts, err := c.listing(subreddit, mode)
 	if err != nil {
-		return "", MediaNone, err
+		return Post{}, err
+	}
+	if len(posts) == 0 {
+		slog.Info("No posts with media in listing", "subreddit", subreddit, "mode", mode)
+		return c.finishPost(Post{}), nil
+	}
+	return c.finishPost(posts[rand.Intn(len(posts))]), nil
+}
+
+// finishPost resolves the media in post (see resolve and fitPreview) and
+// counts its final media type.
+func (c *Client) finishPost(post Post) Post {
+	c.resolve(&post)
+	c.fitPreview(&post)
+	mediaTypes.WithLabelValues(MediaTypeName(post.MediaType)).Inc()
+	return post
+}
+
+// get fetches redditURL using the OAuth token and returns the response body.
+func (c *Client) get(redditURL string) ([]byte, error) {
+	// Refresh token, if needed.
+	if err := c.cred.RefreshToken(); err != nil {
+		return nil, err
 	}
+
 	tok, err := c.cred.Token()
 	if err != nil {
-		return "", MediaNone, err
+		return nil, err
 	}
-	req.Header.Add("Authorization", "bearer "+tok.AccessToken)
-	req.Header.Add("User-agent", userAgent)
 
 	// Create an http client that forwards all headers in case of redirection.
 	// (default behavior for Go http is to not forward Auth to other domains.)
-	httpClient := &http.Client{
-		CheckRedirect: func(redir *http.Request, via []*http.Request) error {
-			// Add an authorization: bearer <token> header if the destination
-			// contains the substring "oauth" (otherwise, we don't need it.)
-			var loc *url.URL
-			loc, err = redir.Response.Location()
-			if err != nil {
-				return err
-			}
-			if strings.Contains(loc.Hostname(), "oauth") {
-				redir.Header.Add("Authorization", "bearer "+tok.AccessToken)
-			}
-
-			// Allow 10 redirects.
-			if len(via) >= 10 {
-				return errors.New("too many redirects")
-			}
-			return nil
-		},
-	}
-
-	resp, err := httpClient.Do(req)
+	base, err := url.Parse(c.baseURL)
 	if err != nil {
-		return "", MediaNone, fmt.Errorf("error fetching reddit URL: %v", err)
+		return nil, err
 	}
-	if resp.StatusCode != http.StatusOK {
-		return "", MediaNone, fmt.Errorf("reddit returned code: %v", resp.StatusCode)
+	httpClient := *c.httpClient
+	httpClient.CheckRedirect = func(redir *http.Request, via []*http.Request) error {
+		// Add an authorization: bearer <token> header if the destination
+		// contains the substring "oauth" or is our base host (otherwise, we
+		// don't need it.)
+		loc, err := redir.Response.Location()
+		if err != nil {
+			return err
+		}
+		if strings.Contains(loc.Hostname(), "oauth") || loc.Host == base.Host {
+			redir.Header.Set("Authorization", "bearer "+tok.AccessToken)
+		}
+
+		// Allow 10 redirects.
+		if len(via) >= 10 {
+			return errors.New("too many redirects")
+		}
+		return nil
 	}
-	defer resp.Body.Close()
 
-	// Decode JSON looking for the "image" attribute.
-	body, err := ioutil.ReadAll(resp.Body)
+	// Create request to the OAuth enabled URL with all tokens.
+	resp, err := do(&httpClient, c.limiter, func() (*http.Request, error) {
+		req, err := http.NewRequest("GET", redditURL, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Add("Authorization", "bearer "+tok.AccessToken)
+		req.Header.Add("User-agent", c.userAgent)
+		return req, nil
+	})
 	if err != nil {
-		return "", MediaNone, err
+		return nil, fmt.Errorf("error fetching reddit URL: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("reddit returned code: %v", resp.StatusCode)
 	}
 
-	return media(body)
+	return ioutil.ReadAll(resp.Body)
 }
 
-// media returns the type of media and media URL for a given json 'list' type.
+// randomPost returns the post in a random article response.
 //
 // It assumes a few things about the JSON input:
 // - [0] (type listing): contains the original message.
 // - data: contains all children.
 // - children: (type Listing): contains the multiple image formats.
 // - [1:n] (type listing): contains children with the comments.
-//
-func media(data []byte) (string, int, error) {
+func randomPost(data []byte) (Post, error) {
 	// We parse the message twice: Once to obtain "data", which contains all
 	// the children with the information we need. Data should exist in all
 	// cases, so we return an error if we get one here. We then parse data
@@ -138,16 +254,58 @@ func media(data []byte) (string, int, error) {
 	// image URLs, so we return "" if an error happens here.
 	rdata, _, _, err := jsonparser.Get(data, "[0]", "data", "children", "[0]", "data")
 	if err != nil {
-		return "", MediaNone, fmt.Errorf("Error decoding 'data' in json: %v: %v", data, err)
+		return Post{}, fmt.Errorf("Error decoding 'data' in json: %v: %v", data, err)
+	}
+	return parsePost(rdata)
+}
+
+// parsePost returns a Post from the "data" object of a post (type t3).
+func parsePost(rdata []byte) (Post, error) {
+	post := Post{}
+	post.ID, _ = jsonparser.GetString(rdata, "id")
+	post.Subreddit, _ = jsonparser.GetString(rdata, "subreddit")
+	post.Title, _ = jsonparser.GetString(rdata, "title")
+	post.Title = html.UnescapeString(post.Title)
+	post.Permalink, _ = jsonparser.GetString(rdata, "permalink")
+	post.URL, _ = jsonparser.GetString(rdata, "url")
+	post.URL = html.UnescapeString(post.URL)
+	post.data = rdata
+
+	var err error
+	post.MediaURL, post.MediaType, err = media(rdata)
+	if err != nil {
+		return post, err
 	}
 
+	// Keep all preview renditions if we're using the preview image, so
+	// fitPreview can pick one within the size limits later.
+	previews := previewImages(rdata)
+	if post.MediaType == MediaImageURL && len(previews) > 0 && previews[0].url == post.MediaURL {
+		post.previews = previews
+	}
+
+	// Thumbnail: the smallest preview rendition, or reddit's thumbnail
+	// (which may also be "self", "default", "nsfw", etc).
+	if len(previews) > 0 {
+		post.Thumbnail = previews[len(previews)-1].url
+	} else if t, _ := jsonparser.GetString(rdata, "thumbnail"); strings.HasPrefix(t, "http") {
+		post.Thumbnail = html.UnescapeString(t)
+	}
+	return post, nil
+}
+
+// media returns the type of media and media URL for the "data" object of a
+// post. Not all posts have media, so we return "" with type MediaNone if
+// none is found.
+func media(rdata []byte) (string, int, error) {
 	// Look for data.media.type. Parsing errors mean we don't have a "type"
-	// field, so they don't really matter (we just log). If for youtube and
-	// gfycat, data.url has the URL of the post.
+	// field, so they don't really matter (we just log). For youtube,
+	// data.url has the URL of the post. Other external hosts are handled by
+	// resolvers (see resolve.go).
 	dtype, err := jsonparser.GetString(rdata, "media", "type")
 	if err == nil {
-		if dtype == "youtube.com" || dtype == "gfycat.com" {
-			log.Printf("Returning media type: %s", dtype)
+		if dtype == "youtube.com" {
+			slog.Debug("Returning media URL", "media_type", dtype)
 			var u string
 			u, err = jsonparser.GetString(rdata, "url")
 			return html.UnescapeString(u), MediaVideoURL, err
@@ -160,24 +318,33 @@ func media(data []byte) (string, int, error) {
 	// client to use NewDocument when posting this link).
 	u, err := jsonparser.GetString(rdata, "media", "reddit_video", "fallback_url")
 	if err == nil {
-		log.Printf("Returning a data.media.fallback_url (reddit_video)")
+		slog.Debug("Returning a data.media.fallback_url (reddit_video)")
 		return html.UnescapeString(u), MediaFileURL, nil
 	}
 
+	// Animated previews (GIFs hosted by reddit, among others) contain an MP4
+	// rendition in preview.images[0].variants.mp4. This is smaller and
+	// plays better in Telegram than the original GIF.
+	u, err = jsonparser.GetString(rdata, "preview", "images", "[0]", "variants", "mp4", "source", "url")
+	if err == nil {
+		slog.Debug("Returning preview MP4 variant (animation)")
+		return html.UnescapeString(u), MediaAnimationURL, nil
+	}
+
 	// Posts with a data.url ending in gif or gifv.
 	u, _ = jsonparser.GetString(rdata, "url")
 	if strings.HasSuffix(u, "gif") || strings.HasSuffix(u, "gifv") {
-		log.Printf("Returning GIF/GIFv URL")
-		return html.UnescapeString(u), MediaImageURL, nil
+		slog.Debug("Returning GIF/GIFv URL")
+		return html.UnescapeString(u), MediaAnimationURL, nil
 	}
 
 	// At this point, we check for regular preview images.
 	u, err = jsonparser.GetString(rdata, "preview", "images", "[0]", "source", "url")
 	if err != nil {
-		log.Printf("Can't find 'preview' in json")
+		slog.Debug("Can't find 'preview' in json")
 		return "", MediaNone, nil
 	}
 	imgURL := html.UnescapeString(u)
-	log.Printf("Plain image preview URL: %s", imgURL)
+	slog.Debug("Plain image preview URL", "url", imgURL)
 	return imgURL, MediaImageURL, nil
 }
@@ -0,0 +1,109 @@
+package reddit
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// testServer starts an httptest server running handler and returns it with
+// an http.Client that sends requests for any host to it. This allows tests
+// to use different host names (e.g. to check redirects across hosts).
+func testServer(t *testing.T, handler http.Handler) (*httptest.Server, *http.Client) {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+
+	addr := srv.Listener.Addr().String()
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, network, addr)
+			},
+		},
+	}
+	return srv, client
+}
+
+func TestClientEndToEnd(t *testing.T) {
+	const (
+		apiHost      = "api.reddit.test"
+		redirectHost = "oauth.redirect.test"
+		videoURL     = "https://v.redd.it/abc/DASH_720.mp4"
+	)
+
+	var (
+		mu          sync.Mutex
+		tokenTries  int
+		randomAuth  string
+		articleAuth string
+	)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("www.reddit.test/api/v1/access_token", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		tokenTries++
+		try := tokenTries
+		mu.Unlock()
+
+		// Reddit throttles token requests. Make sure we retry.
+		if try == 1 {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		user, pass, _ := r.BasicAuth()
+		if r.Method != "POST" || user != "id" || pass != "secret" {
+			t.Errorf("token request: got method %s, basic auth %q/%q", r.Method, user, pass)
+		}
+		if g := r.PostFormValue("grant_type"); g != GrantPassword || r.PostFormValue("username") != "user" || r.PostFormValue("password") != "pass" {
+			t.Errorf("token request: unexpected form %v", r.PostForm)
+		}
+		fmt.Fprint(w, `{"access_token":"tok123","token_type":"bearer","expires_in":3600,"scope":"*"}`)
+	})
+	mux.HandleFunc(apiHost+"/r/aww/random.json", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		randomAuth = r.Header.Get("Authorization")
+		mu.Unlock()
+		http.Redirect(w, r, "http://"+redirectHost+"/r/aww/comments/abc.json", http.StatusFound)
+	})
+	mux.HandleFunc(redirectHost+"/r/aww/comments/abc.json", func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		articleAuth = r.Header.Get("Authorization")
+		mu.Unlock()
+		fmt.Fprintf(w, `[{"kind":"Listing","data":{"children":[{"kind":"t3","data":{"id":"abc","subreddit":"aww","url":"https://v.redd.it/abc","media":{"reddit_video":{"fallback_url":%q}}}}]}},{"kind":"Listing","data":{"children":[]}}]`, videoURL)
+	})
+
+	_, client := testServer(t, mux)
+	c := NewClient("user", "pass", "id", "secret",
+		WithBaseURL("http://"+apiHost),
+		WithTokenURL("http://www.reddit.test/api/v1/access_token"),
+		WithHTTPClient(client))
+
+	u, mediaType, err := c.RandomMediaURL("aww")
+	if err != nil {
+		t.Fatalf("RandomMediaURL: %v", err)
+	}
+	if u != videoURL || mediaType != MediaFileURL {
+		t.Errorf("RandomMediaURL: got %q (type %d), want %q (type %d)", u, mediaType, videoURL, MediaFileURL)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if tokenTries != 2 {
+		t.Errorf("got %d token requests, want 2 (one retry after 429)", tokenTries)
+	}
+	if randomAuth != "bearer tok123" {
+		t.Errorf("random request: got Authorization %q", randomAuth)
+	}
+	// The net/http client drops the Authorization header when redirecting
+	// to another host. Get must add it back for oauth hosts.
+	if articleAuth != "bearer tok123" {
+		t.Errorf("redirected request: got Authorization %q", articleAuth)
+	}
+}
@@ -0,0 +1,231 @@
+package reddit
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/buger/jsonparser"
+	"html"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// API endpoints used by resolvers. These are variables so they can be
+// pointed elsewhere (e.g. a local server serving recorded responses).
+var (
+	imgurAPIURL      = "https://api.imgur.com/3"
+	redgifsAPIURL    = "https://api.redgifs.com/v2"
+	streamableAPIURL = "https://api.streamable.com"
+)
+
+// resolver turns the URL of a post linking to an external host into a
+// direct media URL and media type. rdata holds the post's "data" object, as
+// some hosts have their media mirrored by reddit. Resolvers return MediaNone
+// (and no error) when the URL can't be resolved.
+type resolver func(c *Client, u *url.URL, rdata []byte) (string, int, error)
+
+// resolvers maps host names to resolvers.
+var resolvers = map[string]resolver{}
+
+func init() {
+	registerResolver(resolveImgur, "imgur.com", "i.imgur.com", "m.imgur.com")
+	registerResolver(resolveRedditVideo, "v.redd.it")
+	registerResolver(resolveRedgifs, "redgifs.com", "www.redgifs.com", "v3.redgifs.com", "i.redgifs.com")
+	registerResolver(resolveStreamable, "streamable.com", "www.streamable.com")
+}
+
+// registerResolver registers r as the resolver for the given hosts.
+func registerResolver(r resolver, hosts ...string) {
+	for _, h := range hosts {
+		resolvers[h] = r
+	}
+}
+
+// findResolver returns the resolver for the host in rawURL, or nil.
+func findResolver(rawURL string) (resolver, *url.URL) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil
+	}
+	return resolvers[strings.ToLower(u.Hostname())], u
+}
+
+// resolve replaces the media in post with the direct media URL returned by
+// the resolver for the post URL's host, if any. The media found by parsing
+// the post (usually a preview image) is kept when the resolver fails.
+// Preview renditions are dropped when the media is replaced, so fitPreview
+// doesn't replace the resolved URL with a preview.
+func (c *Client) resolve(post *Post) {
+	r, u := findResolver(post.URL)
+	if r == nil {
+		return
+	}
+	mediaURL, mediaType, err := r(c, u, post.data)
+	if err != nil {
+		slog.Warn("Error resolving media", "url", post.URL, "error", err)
+		return
+	}
+	if mediaType == MediaNone {
+		return
+	}
+	slog.Debug("Resolved media", "url", post.URL, "media_url", mediaURL)
+	post.MediaURL = mediaURL
+	post.MediaType = mediaType
+	post.previews = nil
+}
+
+// getJSON fetches apiURL (from a third party API) and returns the body.
+func (c *Client) getJSON(apiURL string, header http.Header) ([]byte, error) {
+	req, err := http.NewRequest("GET", apiURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("User-agent", c.userAgent)
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned code: %v", req.URL.Host, resp.StatusCode)
+	}
+	return ioutil.ReadAll(resp.Body)
+}
+
+// lastPathElem returns the last element of the URL path, without extension.
+func lastPathElem(u *url.URL) string {
+	base := path.Base(strings.TrimSuffix(u.Path, "/"))
+	return strings.TrimSuffix(base, path.Ext(base))
+}
+
+// resolveImgur handles imgur images, gifv (which are mp4 animations) and
+// albums. Albums need an imgur client ID and resolve to the first image.
+func resolveImgur(c *Client, u *url.URL, _ []byte) (string, int, error) {
+	elems := strings.Split(strings.Trim(u.Path, "/"), "/")
+
+	// Albums and galleries: /a/<id> or /gallery/<id>.
+	if len(elems) == 2 && (elems[0] == "a" || elems[0] == "gallery") {
+		if c.imgurClientID == "" {
+			return "", MediaNone, nil
+		}
+		body, err := c.getJSON(imgurAPIURL+"/album/"+elems[1]+"/images",
+			http.Header{"Authorization": {"Client-ID " + c.imgurClientID}})
+		if err != nil {
+			return "", MediaNone, err
+		}
+		var album struct {
+			Data []struct {
+				Link     string `json:"link"`
+				MP4      string `json:"mp4"`
+				Animated bool   `json:"animated"`
+			} `json:"data"`
+		}
+		if err := json.Unmarshal(body, &album); err != nil {
+			return "", MediaNone, fmt.Errorf("error decoding imgur album: %v", err)
+		}
+		if len(album.Data) == 0 {
+			return "", MediaNone, nil
+		}
+		img := album.Data[0]
+		if img.Animated && img.MP4 != "" {
+			return img.MP4, MediaAnimationURL, nil
+		}
+		return img.Link, MediaImageURL, nil
+	}
+
+	if len(elems) != 1 || elems[0] == "" {
+		return "", MediaNone, nil
+	}
+	id := lastPathElem(u)
+	switch strings.ToLower(path.Ext(u.Path)) {
+	case ".gifv", ".gif", ".mp4":
+		return "https://i.imgur.com/" + id + ".mp4", MediaAnimationURL, nil
+	case ".jpg", ".jpeg", ".png":
+		return "https://i.imgur.com/" + path.Base(u.Path), MediaImageURL, nil
+	case "":
+		// Image pages (imgur.com/<id>). Imgur serves the image under any
+		// image extension.
+		return "https://i.imgur.com/" + id + ".jpg", MediaImageURL, nil
+	}
+	return "", MediaNone, nil
+}
+
+// resolveRedditVideo handles v.redd.it links, including crossposts (where
+// the video lives in the original post).
+func resolveRedditVideo(_ *Client, _ *url.URL, rdata []byte) (string, int, error) {
+	paths := [][]string{
+		{"media", "reddit_video", "fallback_url"},
+		{"secure_media", "reddit_video", "fallback_url"},
+		{"crosspost_parent_list", "[0]", "media", "reddit_video", "fallback_url"},
+		{"crosspost_parent_list", "[0]", "secure_media", "reddit_video", "fallback_url"},
+	}
+	for _, p := range paths {
+		if u, err := jsonparser.GetString(rdata, p...); err == nil {
+			return html.UnescapeString(u), MediaFileURL, nil
+		}
+	}
+	return "", MediaNone, nil
+}
+
+// resolveRedgifs handles redgifs links. Reddit usually mirrors the video in
+// preview.reddit_video_preview. If not, use the redgifs API.
+func resolveRedgifs(c *Client, u *url.URL, rdata []byte) (string, int, error) {
+	if v, err := jsonparser.GetString(rdata, "preview", "reddit_video_preview", "fallback_url"); err == nil {
+		return html.UnescapeString(v), MediaFileURL, nil
+	}
+
+	id := strings.ToLower(lastPathElem(u))
+	if id == "" {
+		return "", MediaNone, nil
+	}
+
+	// The API requires a (free) temporary token.
+	body, err := c.getJSON(redgifsAPIURL+"/auth/temporary", nil)
+	if err != nil {
+		return "", MediaNone, err
+	}
+	token, err := jsonparser.GetString(body, "token")
+	if err != nil {
+		return "", MediaNone, errors.New("no token in redgifs auth response")
+	}
+
+	body, err = c.getJSON(redgifsAPIURL+"/gifs/"+id, http.Header{"Authorization": {"Bearer " + token}})
+	if err != nil {
+		return "", MediaNone, err
+	}
+	for _, q := range []string{"hd", "sd"} {
+		if v, err := jsonparser.GetString(body, "gif", "urls", q); err == nil {
+			return v, MediaFileURL, nil
+		}
+	}
+	return "", MediaNone, nil
+}
+
+// resolveStreamable handles streamable.com links using the streamable API.
+func resolveStreamable(c *Client, u *url.URL, _ []byte) (string, int, error) {
+	id := lastPathElem(u)
+	if id == "" {
+		return "", MediaNone, nil
+	}
+	body, err := c.getJSON(streamableAPIURL+"/videos/"+id, nil)
+	if err != nil {
+		return "", MediaNone, err
+	}
+	v, err := jsonparser.GetString(body, "files", "mp4", "url")
+	if err != nil {
+		return "", MediaNone, nil
+	}
+	// URLs are usually protocol relative.
+	if strings.HasPrefix(v, "//") {
+		v = "https:" + v
+	}
+	return v, MediaFileURL, nil
+}
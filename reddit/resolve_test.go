@@ -0,0 +1,279 @@
+package reddit
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fixtureRequests records the headers of the requests to a fixture server.
+type fixtureRequests struct {
+	mu      sync.Mutex
+	headers map[string]http.Header
+}
+
+// header returns the headers of the last request to path (nil if none).
+func (f *fixtureRequests) header(path string) http.Header {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.headers[path]
+}
+
+// count returns the number of paths requested.
+func (f *fixtureRequests) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.headers)
+}
+
+// fixtureServer starts an httptest server serving the recorded responses in
+// testdata, as given by routes (path -> file name). Requests for any other
+// path fail with 404.
+func fixtureServer(t *testing.T, routes map[string]string) (*httptest.Server, *fixtureRequests) {
+	t.Helper()
+	reqs := &fixtureRequests{headers: map[string]http.Header{}}
+	mux := http.NewServeMux()
+	for p, fname := range routes {
+		p, fname := p, fname
+		mux.HandleFunc(p, func(w http.ResponseWriter, r *http.Request) {
+			reqs.mu.Lock()
+			reqs.headers[p] = r.Header.Clone()
+			reqs.mu.Unlock()
+			buf, err := os.ReadFile(filepath.Join("testdata", fname))
+			if err != nil {
+				t.Errorf("reading fixture: %v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(buf)
+		})
+	}
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return srv, reqs
+}
+
+// readFixture returns the contents of a file in testdata.
+func readFixture(t *testing.T, fname string) []byte {
+	t.Helper()
+	buf, err := os.ReadFile(filepath.Join("testdata", fname))
+	if err != nil {
+		t.Fatalf("reading fixture: %v", err)
+	}
+	return buf
+}
+
+// setAPIURL points *v to u for the duration of the test.
+func setAPIURL(t *testing.T, v *string, u string) {
+	t.Helper()
+	old := *v
+	*v = u
+	t.Cleanup(func() { *v = old })
+}
+
+// resolverTest holds a test case for a resolver.
+type resolverTest struct {
+	name      string
+	url       string
+	rdata     []byte
+	wantURL   string
+	wantType  int
+	wantError bool
+}
+
+// runResolverTests runs r on each test case using client c.
+func runResolverTests(t *testing.T, c *Client, r resolver, tests []resolverTest) {
+	t.Helper()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u, err := url.Parse(tt.url)
+			if err != nil {
+				t.Fatalf("invalid test URL: %v", err)
+			}
+			got, gotType, err := r(c, u, tt.rdata)
+			if (err != nil) != tt.wantError {
+				t.Fatalf("got error %v, want error: %v", err, tt.wantError)
+			}
+			if got != tt.wantURL || gotType != tt.wantType {
+				t.Errorf("got %q (type %d), want %q (type %d)", got, gotType, tt.wantURL, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestResolveImgur(t *testing.T) {
+	srv, reqs := fixtureServer(t, map[string]string{
+		"/3/album/aNiM8/images": "imgur_album.json",
+		"/3/album/sTiLl/images": "imgur_album_still.json",
+	})
+	setAPIURL(t, &imgurAPIURL, srv.URL+"/3")
+
+	c := NewClient("", "", "", "", WithImgurClientID("imgur-id"))
+	runResolverTests(t, c, resolveImgur, []resolverTest{
+		{name: "direct image", url: "https://i.imgur.com/b7RtWq1.png", wantURL: "https://i.imgur.com/b7RtWq1.png", wantType: MediaImageURL},
+		{name: "image page", url: "https://imgur.com/b7RtWq1", wantURL: "https://i.imgur.com/b7RtWq1.jpg", wantType: MediaImageURL},
+		{name: "gifv", url: "https://i.imgur.com/Xk2LmQp.gifv", wantURL: "https://i.imgur.com/Xk2LmQp.mp4", wantType: MediaAnimationURL},
+		{name: "gif", url: "https://i.imgur.com/Xk2LmQp.gif", wantURL: "https://i.imgur.com/Xk2LmQp.mp4", wantType: MediaAnimationURL},
+		{name: "unknown extension", url: "https://i.imgur.com/Xk2LmQp.zip", wantType: MediaNone},
+		{name: "animated album", url: "https://imgur.com/a/aNiM8", wantURL: "https://i.imgur.com/Xk2LmQp.mp4", wantType: MediaAnimationURL},
+		{name: "still album", url: "https://imgur.com/a/sTiLl", wantURL: "https://i.imgur.com/b7RtWq1.jpg", wantType: MediaImageURL},
+		{name: "album not found", url: "https://imgur.com/a/missing", wantType: MediaNone, wantError: true},
+	})
+	if got := reqs.header("/3/album/aNiM8/images").Get("Authorization"); got != "Client-ID imgur-id" {
+		t.Errorf("album request: got Authorization %q, want %q", got, "Client-ID imgur-id")
+	}
+
+	// Without a client ID, albums are not resolved (and the API is not
+	// called).
+	calls := reqs.count()
+	runResolverTests(t, NewClient("", "", "", ""), resolveImgur, []resolverTest{
+		{name: "album without client ID", url: "https://imgur.com/a/aNiM8", wantType: MediaNone},
+		{name: "gallery without client ID", url: "https://imgur.com/gallery/x", wantType: MediaNone},
+	})
+	if reqs.count() != calls {
+		t.Errorf("imgur API called without a client ID")
+	}
+}
+
+func TestResolveRedditVideo(t *testing.T) {
+	runResolverTests(t, NewClient("", "", "", ""), resolveRedditVideo, []resolverTest{
+		{
+			name:     "video post",
+			url:      "https://v.redd.it/k8w3n2p1q9tb1",
+			rdata:    readFixture(t, "post_vreddit.json"),
+			wantURL:  "https://v.redd.it/k8w3n2p1q9tb1/DASH_720.mp4?source=fallback",
+			wantType: MediaFileURL,
+		},
+		{
+			name:     "crosspost",
+			url:      "https://v.redd.it/k8w3n2p1q9tb1",
+			rdata:    readFixture(t, "post_vreddit_crosspost.json"),
+			wantURL:  "https://v.redd.it/k8w3n2p1q9tb1/DASH_480.mp4?source=fallback&x=1",
+			wantType: MediaFileURL,
+		},
+		{
+			name:     "no video",
+			url:      "https://v.redd.it/k8w3n2p1q9tb1",
+			rdata:    []byte(`{"id":"17a2b3c","media":null}`),
+			wantType: MediaNone,
+		},
+	})
+}
+
+func TestResolveRedgifs(t *testing.T) {
+	srv, reqs := fixtureServer(t, map[string]string{
+		"/v2/auth/temporary":        "redgifs_auth.json",
+		"/v2/gifs/happysleepyotter": "redgifs_gif.json",
+	})
+	setAPIURL(t, &redgifsAPIURL, srv.URL+"/v2")
+
+	runResolverTests(t, NewClient("", "", "", ""), resolveRedgifs, []resolverTest{
+		{
+			name:     "reddit preview mirror",
+			url:      "https://www.redgifs.com/watch/happysleepyotter",
+			rdata:    readFixture(t, "post_redgifs_preview.json"),
+			wantURL:  "https://v.redd.it/pv9x8c7b6n5m/DASH_720.mp4",
+			wantType: MediaFileURL,
+		},
+		{
+			name:     "API",
+			url:      "https://www.redgifs.com/watch/HappySleepyOtter",
+			rdata:    []byte(`{"id":"17g6h7i"}`),
+			wantURL:  "https://thumbs44.redgifs.com/HappySleepyOtter.mp4",
+			wantType: MediaFileURL,
+		},
+		{
+			name:      "API not found",
+			url:       "https://www.redgifs.com/watch/missing",
+			rdata:     []byte(`{"id":"17g6h7i"}`),
+			wantType:  MediaNone,
+			wantError: true,
+		},
+	})
+
+	const wantAuth = "Bearer eyJhbGciOiJSUzI1NiIsInR5cCI6IkpXVCJ9.test.signature"
+	if got := reqs.header("/v2/gifs/happysleepyotter").Get("Authorization"); got != wantAuth {
+		t.Errorf("gif request: got Authorization %q, want %q", got, wantAuth)
+	}
+}
+
+func TestResolveStreamable(t *testing.T) {
+	srv, _ := fixtureServer(t, map[string]string{
+		"/videos/x1y2z3": "streamable_video.json",
+	})
+	setAPIURL(t, &streamableAPIURL, srv.URL)
+
+	runResolverTests(t, NewClient("", "", "", ""), resolveStreamable, []resolverTest{
+		{
+			name:     "protocol relative URL",
+			url:      "https://streamable.com/x1y2z3",
+			wantURL:  "https://cdn-cf-east.streamable.com/video/mp4/x1y2z3.mp4?Expires=1697300000&Signature=abc&Key-Pair-Id=APKAIEYUVEN4EVB2OKEQ",
+			wantType: MediaFileURL,
+		},
+		{name: "not found", url: "https://streamable.com/missing", wantType: MediaNone, wantError: true},
+		{name: "no video ID", url: "https://streamable.com/", wantType: MediaNone},
+	})
+}
+
+func TestResolveKeepsResolvedImage(t *testing.T) {
+	// An imgur image page with a reddit preview. The resolved imgur URL
+	// must not be replaced by a preview rendition.
+	rdata := []byte(`{"id":"17j8k9l","url":"https://imgur.com/b7RtWq1","preview":{"images":[{"source":{"url":"https://external-preview.redd.it/b7RtWq1.jpg","width":1080,"height":1350}}]}}`)
+	post, err := parsePost(rdata)
+	if err != nil {
+		t.Fatalf("parsePost: %v", err)
+	}
+	if len(post.previews) == 0 {
+		t.Fatalf("expected preview renditions in post")
+	}
+
+	c := NewClient("", "", "", "", WithPreviewLimits(0, 0))
+	c.resolve(&post)
+	c.fitPreview(&post)
+
+	const want = "https://i.imgur.com/b7RtWq1.jpg"
+	if post.MediaURL != want || post.MediaType != MediaImageURL {
+		t.Errorf("got %q (type %d), want %q (type %d)", post.MediaURL, post.MediaType, want, MediaImageURL)
+	}
+}
+
+func TestResolverTimeout(t *testing.T) {
+	// A hung third party API must not block the resolver forever.
+	block := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-block
+	}))
+	defer srv.Close()
+	defer close(block)
+	setAPIURL(t, &streamableAPIURL, srv.URL)
+
+	c := NewClient("", "", "", "")
+	c.httpClient.Timeout = 100 * time.Millisecond
+
+	done := make(chan error, 1)
+	go func() {
+		u, _ := url.Parse("https://streamable.com/x1y2z3")
+		_, _, err := resolveStreamable(c, u, nil)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Errorf("expected a timeout error")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("resolver blocked on a hung API")
+	}
+}
+
+func TestDefaultTimeout(t *testing.T) {
+	if c := NewClient("", "", "", ""); c.httpClient.Timeout == 0 {
+		t.Errorf("default HTTP client has no timeout")
+	}
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"mime"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+const (
+	// Source used by triggers that don't specify one.
+	defaultSource = "reddit"
+)
+
+// MIME types for extensions not always known to the mime package (which
+// depends on the system's mime.types file for most video formats).
+var extMIMETypes = map[string]string{
+	".mp4":  "video/mp4",
+	".m4v":  "video/mp4",
+	".webm": "video/webm",
+}
+
+// MediaSource defines the interface between this bot and a source of random
+// media (reddit, local directories, feeds, etc). RandomPost receives the
+// source specific target configured in the trigger (a subreddit name, a
+// directory, a feed URL...) and fetch mode, and returns a post with the
+// media URL and one of the media* types.
+type MediaSource interface {
+	RandomPost(string, string) (mediaPost, error)
+}
+
+// sourceFactory creates a new MediaSource from the bot configuration.
+type sourceFactory func(botConfig) (MediaSource, error)
+
+// sourceFactories maps source names (as used in the "source" trigger
+// field) to the factory functions creating them. Sources add themselves to
+// this map with registerSource, usually from init().
+var sourceFactories = map[string]sourceFactory{}
+
+// registerSource makes a media source available to triggers under name.
+func registerSource(name string, f sourceFactory) {
+	if _, ok := sourceFactories[name]; ok {
+		panic("duplicate media source: " + name)
+	}
+	sourceFactories[name] = f
+}
+
+// mediaSources maps source names to initialized media sources.
+type mediaSources map[string]MediaSource
+
+// newMediaSources initializes every media source used by the configured
+// triggers. Sources not used by any trigger are not created.
+func newMediaSources(config botConfig) (mediaSources, error) {
+	var names []string
+	for _, rule := range config.triggerConfig {
+		names = append(names, rule.source)
+	}
+	// Inline mode uses reddit.
+	if config.Inline {
+		names = append(names, "reddit")
+	}
+
+	sources := mediaSources{}
+	for _, name := range names {
+		if _, ok := sources[name]; ok {
+			continue
+		}
+		f, ok := sourceFactories[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown media source: %q", name)
+		}
+		src, err := f(config)
+		if err != nil {
+			return nil, fmt.Errorf("error initializing media source %q: %v", name, err)
+		}
+		sources[name] = src
+	}
+	return sources, nil
+}
+
+// sourceNames returns a sorted list with the names of all registered
+// media sources.
+func sourceNames() []string {
+	var names []string
+	for name := range sourceFactories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mediaTypeFromMIME returns the media type for a MIME type: GIFs are sent as
+// animations, other images as photos and videos as files.
+func mediaTypeFromMIME(mtype string) int {
+	switch {
+	case mtype == "image/gif":
+		return mediaAnimation
+	case strings.HasPrefix(mtype, "image/"):
+		return mediaImage
+	case strings.HasPrefix(mtype, "video/"):
+		return mediaFile
+	}
+	return mediaNone
+}
+
+// mediaTypeFromName returns the media type for a file name (or URL path)
+// based on the MIME type of its extension.
+func mediaTypeFromName(name string) int {
+	ext := strings.ToLower(filepath.Ext(name))
+	mtype, ok := extMIMETypes[ext]
+	if !ok {
+		mtype = mime.TypeByExtension(ext)
+	}
+	return mediaTypeFromMIME(mtype)
+}
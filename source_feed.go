@@ -0,0 +1,272 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"golang.org/x/sync/singleflight"
+	"html"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Default interval between feed fetches.
+	defaultFeedRefresh = 30 * time.Minute
+
+	// User agent used to fetch feeds.
+	feedUserAgent = "github.com/marcopaganini/pixiebot"
+)
+
+// imgSrcRegex matches the src attribute of <img> tags in HTML content.
+var imgSrcRegex = regexp.MustCompile(`(?i)<img[^>]+src\s*=\s*["']([^"']+)["']`)
+
+// feedConfig holds the configuration for the RSS/Atom feed source.
+type feedConfig struct {
+	// Interval between feed fetches (e.g. "15m", "1h").
+	Refresh string `toml:"refresh"`
+}
+
+// feedMedia represents a media item extracted from a feed.
+type feedMedia struct {
+	url       string
+	mediaType int
+}
+
+// feedCache holds the media items from a feed and the time of the fetch.
+type feedCache struct {
+	media   []feedMedia
+	fetched time.Time
+}
+
+// feedSource picks random media from RSS and Atom feeds. Targets are feed
+// URLs. Feeds are cached and fetched again after the refresh interval.
+type feedSource struct {
+	client  *http.Client
+	refresh time.Duration
+
+	// mu protects cache. Concurrent fetches of the same feed are collapsed
+	// into a single request by sf.
+	mu    sync.Mutex
+	sf    singleflight.Group
+	cache map[string]feedCache
+}
+
+// Minimal RSS 2.0 and Atom representation. We only care about the parts that
+// may contain media: enclosures, Media RSS elements and HTML content.
+type rssFeed struct {
+	Items []struct {
+		Description string `xml:"description"`
+		Content     string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+		Enclosures  []struct {
+			URL  string `xml:"url,attr"`
+			Type string `xml:"type,attr"`
+		} `xml:"enclosure"`
+		MediaContent []struct {
+			URL    string `xml:"url,attr"`
+			Type   string `xml:"type,attr"`
+			Medium string `xml:"medium,attr"`
+		} `xml:"http://search.yahoo.com/mrss/ content"`
+	} `xml:"channel>item"`
+}
+
+type atomFeed struct {
+	Entries []struct {
+		Content string `xml:"content"`
+		Summary string `xml:"summary"`
+		Links   []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+			Type string `xml:"type,attr"`
+		} `xml:"link"`
+	} `xml:"entry"`
+}
+
+func init() {
+	registerSource("rss", newFeedSource)
+}
+
+// newFeedSource returns a new RSS/Atom feed MediaSource.
+func newFeedSource(config botConfig) (MediaSource, error) {
+	refresh := defaultFeedRefresh
+	if config.RSS.Refresh != "" {
+		var err error
+		refresh, err = time.ParseDuration(config.RSS.Refresh)
+		if err != nil {
+			return nil, fmt.Errorf("invalid feed refresh interval: %v", err)
+		}
+	}
+	return &feedSource{
+		client:  &http.Client{Timeout: time.Minute},
+		refresh: refresh,
+		cache:   map[string]feedCache{},
+	}, nil
+}
+
+// RandomPost returns a post with a random media URL from the feed at
+// feedURL. The mode is ignored.
+func (f *feedSource) RandomPost(feedURL, _ string) (mediaPost, error) {
+	media, err := f.media(feedURL)
+	if err != nil {
+		return mediaPost{}, err
+	}
+	if len(media) == 0 {
+		return mediaPost{}, nil
+	}
+	m := media[rand.Intn(len(media))]
+	return mediaPost{ID: m.url, MediaURL: m.url, MediaType: m.mediaType}, nil
+}
+
+// media returns the media items in the feed, fetching it again if the cached
+// copy is older than the refresh interval. A stale copy is returned if the
+// fetch fails.
+func (f *feedSource) media(feedURL string) ([]feedMedia, error) {
+	f.mu.Lock()
+	cached, ok := f.cache[feedURL]
+	f.mu.Unlock()
+	if ok && time.Since(cached.fetched) < f.refresh {
+		return cached.media, nil
+	}
+
+	// Don't hold the lock while fetching (which may take a while), so
+	// other feeds are not blocked.
+	v, err, _ := f.sf.Do(feedURL, func() (interface{}, error) {
+		return f.fetch(feedURL)
+	})
+	if err != nil {
+		if ok {
+			slog.Warn("Error fetching feed (using cached copy)", "feed", feedURL, "error", err)
+			return cached.media, nil
+		}
+		return nil, err
+	}
+	media := v.([]feedMedia)
+	slog.Info("Fetched feed", "feed", feedURL, "media_items", len(media))
+
+	f.mu.Lock()
+	f.cache[feedURL] = feedCache{media: media, fetched: time.Now()}
+	f.mu.Unlock()
+	return media, nil
+}
+
+// fetch downloads and parses the feed at feedURL.
+func (f *feedSource) fetch(feedURL string) ([]feedMedia, error) {
+	req, err := http.NewRequest("GET", feedURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("User-agent", feedUserAgent)
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching feed: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("feed returned code: %v", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	// Relative URLs are relative to the feed's final URL (after redirects).
+	return parseFeed(resp.Request.URL, body)
+}
+
+// parseFeed extracts all media from an RSS or Atom feed. Relative media URLs
+// are resolved against base. Only http and https URLs are used, since
+// anything else (e.g. file://) can't be fetched by Telegram.
+func parseFeed(base *url.URL, data []byte) ([]feedMedia, error) {
+	var root struct {
+		XMLName xml.Name
+	}
+	if err := xml.Unmarshal(data, &root); err != nil {
+		return nil, fmt.Errorf("error decoding feed: %v", err)
+	}
+
+	var media []feedMedia
+	seen := map[string]bool{}
+	add := func(rawURL, mtype string) {
+		rawURL = strings.TrimSpace(html.UnescapeString(rawURL))
+		if rawURL == "" {
+			return
+		}
+		ref, err := url.Parse(rawURL)
+		if err != nil {
+			return
+		}
+		p := base.ResolveReference(ref)
+		if p.Scheme != "http" && p.Scheme != "https" {
+			return
+		}
+		u := p.String()
+		if seen[u] {
+			return
+		}
+		seen[u] = true
+		t := mediaTypeFromMIME(mtype)
+		if mtype == "" {
+			// No type information. Use the extension, if any, or assume
+			// it's an image (e.g. <img> tags without extensions).
+			t = mediaImage
+			if path.Ext(p.Path) != "" {
+				t = mediaTypeFromName(p.Path)
+			}
+		}
+		if t != mediaNone {
+			media = append(media, feedMedia{url: u, mediaType: t})
+		}
+	}
+	addImages := func(content string) {
+		for _, m := range imgSrcRegex.FindAllStringSubmatch(content, -1) {
+			add(m[1], "")
+		}
+	}
+
+	switch root.XMLName.Local {
+	case "rss":
+		var feed rssFeed
+		if err := xml.Unmarshal(data, &feed); err != nil {
+			return nil, fmt.Errorf("error decoding RSS feed: %v", err)
+		}
+		for _, item := range feed.Items {
+			for _, e := range item.Enclosures {
+				add(e.URL, e.Type)
+			}
+			for _, mc := range item.MediaContent {
+				mtype := mc.Type
+				if mtype == "" && mc.Medium != "" {
+					mtype = mc.Medium + "/"
+				}
+				add(mc.URL, mtype)
+			}
+			addImages(item.Description)
+			addImages(item.Content)
+		}
+	case "feed":
+		var feed atomFeed
+		if err := xml.Unmarshal(data, &feed); err != nil {
+			return nil, fmt.Errorf("error decoding Atom feed: %v", err)
+		}
+		for _, entry := range feed.Entries {
+			for _, l := range entry.Links {
+				if l.Rel == "enclosure" {
+					add(l.Href, l.Type)
+				}
+			}
+			addImages(entry.Content)
+			addImages(entry.Summary)
+		}
+	default:
+		return nil, fmt.Errorf("unknown feed format: <%s>", root.XMLName.Local)
+	}
+	return media, nil
+}
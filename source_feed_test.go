@@ -0,0 +1,137 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestParseFeed(t *testing.T) {
+	base, err := url.Parse("https://example.com/comics/feed.xml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		feed string
+		want []feedMedia
+	}{
+		{
+			name: "RSS enclosures",
+			feed: `<?xml version="1.0"?>
+<rss version="2.0"><channel><item>
+  <title>Episode 1</title>
+  <enclosure url="https://cdn.example.com/ep1.mp4" length="1000" type="video/mp4"/>
+  <enclosure url="https://cdn.example.com/ep1.mp3" length="1000" type="audio/mpeg"/>
+  <enclosure url="https://cdn.example.com/ep1.gif" length="1000" type="image/gif"/>
+</item></channel></rss>`,
+			want: []feedMedia{
+				{url: "https://cdn.example.com/ep1.mp4", mediaType: mediaFile},
+				{url: "https://cdn.example.com/ep1.gif", mediaType: mediaAnimation},
+			},
+		},
+		{
+			name: "RSS media:content with only medium",
+			feed: `<?xml version="1.0"?>
+<rss version="2.0" xmlns:media="http://search.yahoo.com/mrss/"><channel><item>
+  <media:content url="https://cdn.example.com/strip.png" medium="image"/>
+  <media:content url="https://cdn.example.com/clip" medium="video"/>
+</item></channel></rss>`,
+			want: []feedMedia{
+				{url: "https://cdn.example.com/strip.png", mediaType: mediaImage},
+				{url: "https://cdn.example.com/clip", mediaType: mediaFile},
+			},
+		},
+		{
+			name: "RSS img in content:encoded and description",
+			feed: `<?xml version="1.0"?>
+<rss version="2.0" xmlns:content="http://purl.org/rss/1.0/modules/content/"><channel><item>
+  <description>&lt;p&gt;Today's strip&lt;/p&gt;&lt;img src="https://cdn.example.com/a.jpg" alt=""&gt;</description>
+  <content:encoded><![CDATA[<p>Today's strip</p><img class="strip" src='https://cdn.example.com/b.gif'>]]></content:encoded>
+</item></channel></rss>`,
+			want: []feedMedia{
+				{url: "https://cdn.example.com/a.jpg", mediaType: mediaImage},
+				{url: "https://cdn.example.com/b.gif", mediaType: mediaAnimation},
+			},
+		},
+		{
+			name: "relative URLs",
+			feed: `<?xml version="1.0"?>
+<rss version="2.0" xmlns:content="http://purl.org/rss/1.0/modules/content/"><channel><item>
+  <enclosure url="/media/ep2.mp4" type="video/mp4"/>
+  <content:encoded><![CDATA[<img src="strips/2.png"><img src="//img.example.net/3.jpg">]]></content:encoded>
+</item></channel></rss>`,
+			want: []feedMedia{
+				{url: "https://example.com/media/ep2.mp4", mediaType: mediaFile},
+				{url: "https://example.com/comics/strips/2.png", mediaType: mediaImage},
+				{url: "https://img.example.net/3.jpg", mediaType: mediaImage},
+			},
+		},
+		{
+			name: "non-http URLs are rejected",
+			feed: `<?xml version="1.0"?>
+<rss version="2.0" xmlns:media="http://search.yahoo.com/mrss/" xmlns:content="http://purl.org/rss/1.0/modules/content/"><channel><item>
+  <enclosure url="file:///home/bot/.config/pixiebot/config.toml" type="video/mp4"/>
+  <enclosure url="FILE:///etc/passwd" type="image/png"/>
+  <media:content url="ftp://example.com/a.png" medium="image"/>
+  <content:encoded><![CDATA[<img src="data:image/png;base64,iVBORw0KGgo="><img src="javascript:alert(1)"><img src="https://cdn.example.com/ok.png">]]></content:encoded>
+  <enclosure url="" type="video/mp4"/>
+</item></channel></rss>`,
+			want: []feedMedia{
+				{url: "https://cdn.example.com/ok.png", mediaType: mediaImage},
+			},
+		},
+		{
+			name: "Atom",
+			feed: `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom"><entry>
+  <title>Strip 3</title>
+  <link rel="alternate" href="https://example.com/comics/3"/>
+  <link rel="enclosure" href="https://cdn.example.com/3.webm" type="video/webm"/>
+  <link rel="enclosure" href="file:///etc/passwd" type="image/png"/>
+  <content type="html">&lt;img src="/img/3.png"&gt;</content>
+  <summary type="html">&lt;img src="data:image/gif;base64,R0lGODlh"&gt;</summary>
+</entry></feed>`,
+			want: []feedMedia{
+				{url: "https://cdn.example.com/3.webm", mediaType: mediaFile},
+				{url: "https://example.com/img/3.png", mediaType: mediaImage},
+			},
+		},
+		{
+			name: "duplicates",
+			feed: `<?xml version="1.0"?>
+<rss version="2.0"><channel>
+  <item><enclosure url="https://cdn.example.com/a.png" type="image/png"/></item>
+  <item><description>&lt;img src="https://cdn.example.com/a.png"&gt;</description></item>
+</channel></rss>`,
+			want: []feedMedia{
+				{url: "https://cdn.example.com/a.png", mediaType: mediaImage},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseFeed(base, []byte(tt.feed))
+			if err != nil {
+				t.Fatalf("parseFeed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseFeedErrors(t *testing.T) {
+	base, _ := url.Parse("https://example.com/feed.xml")
+	for _, feed := range []string{
+		"not xml",
+		`<?xml version="1.0"?><html><body></body></html>`,
+	} {
+		if _, err := parseFeed(base, []byte(feed)); err == nil {
+			t.Errorf("parseFeed(%q): expected error", feed)
+		}
+	}
+}
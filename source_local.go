@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"math/rand"
+	"net/url"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// Prefix for media URLs pointing to local files. These are only
+	// informational (e.g. in logs): the send handlers upload the file in
+	// the post's LocalFile.
+	fileURLPrefix = "file://"
+)
+
+// Default glob filters for the local source.
+var defaultLocalGlobs = []string{"*.jpg", "*.jpeg", "*.png", "*.gif", "*.mp4", "*.webm"}
+
+// localConfig holds the configuration for the local directory source.
+type localConfig struct {
+	// Only files whose names match one of these glob patterns are used.
+	Globs []string `toml:"globs"`
+	// Scan subdirectories.
+	Recursive bool `toml:"recursive"`
+}
+
+// localSource picks random media files from local directories. Targets are
+// directory names.
+type localSource struct {
+	globs     []string
+	recursive bool
+}
+
+func init() {
+	registerSource("local", newLocalSource)
+}
+
+// newLocalSource returns a new local directory MediaSource.
+func newLocalSource(config botConfig) (MediaSource, error) {
+	globs := config.Local.Globs
+	if len(globs) == 0 {
+		globs = defaultLocalGlobs
+	}
+	// Catch bad patterns early.
+	for _, g := range globs {
+		if _, err := filepath.Match(g, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %v", g, err)
+		}
+	}
+	return &localSource{globs: globs, recursive: config.Local.Recursive}, nil
+}
+
+// RandomPost returns a post for a random media file under the directory
+// dir, with the media type of the file. The file is set in LocalFile (and
+// as a file:// media URL). The mode is ignored.
+func (l *localSource) RandomPost(dir, _ string) (mediaPost, error) {
+	files, err := l.scan(dir)
+	if err != nil {
+		return mediaPost{}, err
+	}
+	if len(files) == 0 {
+		return mediaPost{}, nil
+	}
+	f := files[rand.Intn(len(files))]
+	return mediaPost{
+		ID:        f,
+		Title:     filepath.Base(f),
+		MediaURL:  fileURLPrefix + (&url.URL{Path: f}).EscapedPath(),
+		MediaType: mediaTypeFromName(f),
+		LocalFile: f,
+	}, nil
+}
+
+// scan returns the absolute path of all usable media files under dir.
+func (l *localSource) scan(dir string) ([]string, error) {
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	err = filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != dir && !l.recursive {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || !l.match(d.Name()) || mediaTypeFromName(path) == mediaNone {
+			return nil
+		}
+		files = append(files, path)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading directory %s: %v", dir, err)
+	}
+	return files, nil
+}
+
+// match returns true if name matches any of the configured globs.
+func (l *localSource) match(name string) bool {
+	for _, g := range l.globs {
+		if ok, _ := filepath.Match(g, name); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(g, strings.ToLower(name)); ok {
+			return true
+		}
+	}
+	return false
+}
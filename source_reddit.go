@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"github.com/marcopaganini/pixiebot/reddit"
+	"time"
+)
+
+func init() {
+	registerSource("reddit", newRedditSource)
+}
+
+// newRedditSource returns a reddit client as a MediaSource. Targets are
+// subreddit names. If prefetch is set, posts for every configured subreddit
+// are fetched in advance, in the background.
+func newRedditSource(config botConfig) (MediaSource, error) {
+	opts := []reddit.Option{
+		reddit.WithGrant(config.Grant),
+		reddit.WithDeviceID(config.DeviceID),
+		reddit.WithRefreshToken(config.refreshToken),
+		reddit.WithImgurClientID(config.ImgurClientID),
+	}
+	if config.ListingTTL != "" {
+		ttl, err := time.ParseDuration(config.ListingTTL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listing_ttl: %v", err)
+		}
+		opts = append(opts, reddit.WithListingTTL(ttl))
+	}
+	if config.PreviewMaxSize > 0 || config.PreviewMaxBytes > 0 {
+		opts = append(opts, reddit.WithPreviewLimits(
+			valueOrDefault(config.PreviewMaxSize, reddit.DefaultPreviewMaxSize),
+			valueOrDefault(config.PreviewMaxBytes, reddit.DefaultPreviewMaxBytes)))
+	}
+
+	src := &redditSource{client: reddit.NewClient(config.Username, config.Password, config.ClientID, config.Secret, opts...)}
+
+	if config.Prefetch > 0 {
+		return newPrefetchSource(src, "reddit", config.triggerConfig, config.Prefetch), nil
+	}
+	return src, nil
+}
+
+// redditMediaTypes maps the reddit package media types to media types.
+var redditMediaTypes = map[int]int{
+	reddit.MediaNone:         mediaNone,
+	reddit.MediaImageURL:     mediaImage,
+	reddit.MediaFileURL:      mediaFile,
+	reddit.MediaVideoURL:     mediaVideo,
+	reddit.MediaAnimationURL: mediaAnimation,
+}
+
+// redditSource adapts a reddit client to the MediaSource interface.
+type redditSource struct {
+	client *reddit.Client
+}
+
+// RandomPost returns a random post with media from subreddit, fetched as
+// specified by mode (see reddit.Client.RandomPost).
+func (r *redditSource) RandomPost(subreddit, mode string) (mediaPost, error) {
+	post, err := r.client.RandomPost(subreddit, mode)
+	if err != nil {
+		return mediaPost{}, err
+	}
+	return mediaPost{
+		ID:        post.ID,
+		Title:     post.Title,
+		Permalink: post.Permalink,
+		Subreddit: post.Subreddit,
+		MediaURL:  post.MediaURL,
+		MediaType: redditMediaTypes[post.MediaType],
+		Thumbnail: post.Thumbnail,
+	}, nil
+}
+
+// Token returns the reddit client's OAuth token.
+func (r *redditSource) Token() (*reddit.Token, error) {
+	return r.client.Token()
+}
+
+// valueOrDefault returns v, or def if v is zero.
+func valueOrDefault(v, def int64) int64 {
+	if v == 0 {
+		return def
+	}
+	return v
+}
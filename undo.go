@@ -0,0 +1,146 @@
+package main
+
+import (
+	"gopkg.in/telegram-bot-api.v4"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// Number of posts remembered per chat for /undo, /delete and votes.
+const sentHistorySize = 100
+
+// sentPost is a post sent by the bot.
+type sentPost struct {
+	messageID int
+	postID    string
+
+	// Subreddit (or source target) the post came from.
+	subreddit string
+
+	// Trigger rule that produced the post.
+	rule string
+
+	// Forum topic the post was sent to (zero for none).
+	threadID int
+
+	// Message that triggered the post (possibly in another chat).
+	trigger postTrigger
+
+	// Votes on the post, by user ID (see votes.go).
+	votes map[int]int
+}
+
+// sentPosts keeps the latest posts sent by the bot, per chat.
+type sentPosts struct {
+	mu    sync.Mutex
+	chats map[int64][]*sentPost
+}
+
+// sent holds the latest posts sent by the bot.
+var sent = &sentPosts{chats: map[int64][]*sentPost{}}
+
+// add records a post sent to chatID, forgetting the oldest one if needed.
+func (s *sentPosts) add(chatID int64, p *sentPost) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	posts := append(s.chats[chatID], p)
+	if len(posts) > sentHistorySize {
+		posts = posts[len(posts)-sentHistorySize:]
+	}
+	s.chats[chatID] = posts
+}
+
+// find returns the post sent as messageID to chatID, or nil. A zero
+// messageID means the latest post.
+func (s *sentPosts) find(chatID int64, messageID int) *sentPost {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i := s.index(chatID, messageID); i >= 0 {
+		return s.chats[chatID][i]
+	}
+	return nil
+}
+
+// remove removes and returns the post sent as messageID to chatID, or nil.
+// A zero messageID means the latest post.
+func (s *sentPosts) remove(chatID int64, messageID int) *sentPost {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.index(chatID, messageID)
+	if i < 0 {
+		return nil
+	}
+	posts := s.chats[chatID]
+	p := posts[i]
+	s.chats[chatID] = append(posts[:i], posts[i+1:]...)
+	return p
+}
+
+// triggeredBy returns true if a post was sent (to any chat) in response to
+// messageID in chatID.
+func (s *sentPosts) triggeredBy(chatID int64, messageID int) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, posts := range s.chats {
+		for _, p := range posts {
+			if p.trigger.chatID == chatID && p.trigger.messageID == messageID {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// index returns the index of the post sent as messageID to chatID, or -1.
+// Must be called with s.mu held.
+func (s *sentPosts) index(chatID int64, messageID int) int {
+	posts := s.chats[chatID]
+	for i := len(posts) - 1; i >= 0; i-- {
+		if messageID == 0 || posts[i].messageID == messageID {
+			return i
+		}
+	}
+	return -1
+}
+
+// undo handles the /undo (delete the bot's latest post) and /delete (as a
+// reply to one of the bot's posts) commands. The post is deleted and
+// blocked in the chat. With "subreddit" as argument, the subreddit is
+// blocked as well. Returns the text to send back to the chat, if any.
+func undo(bot tgbotSender, msg *tgbotapi.Message) string {
+	chatID := msg.Chat.ID
+
+	messageID := 0
+	if msg.Command() == "delete" {
+		if msg.ReplyToMessage == nil {
+			return "Reply to one of my posts with /delete to remove it."
+		}
+		messageID = msg.ReplyToMessage.MessageID
+	}
+
+	post := sent.remove(chatID, messageID)
+	if post == nil {
+		return "Sorry, I can't find that post (I only remember my recent posts)."
+	}
+
+	logger := slog.With("chat_id", chatID, "user_id", messageUserID(msg), "post_id", post.postID, "subreddit", post.subreddit)
+
+	if _, err := bot.Send(tgbotapi.NewDeleteMessage(chatID, post.messageID)); err != nil {
+		logger.Error("Error deleting post", "error", err)
+		return "Sorry, I couldn't delete that post. Am I allowed to delete messages here?"
+	}
+	if err := blocklist.blockPost(chatID, post.postID); err != nil {
+		logger.Error("Error saving blocklist", "error", err)
+	}
+	logger.Info("Post deleted and blocked")
+
+	if strings.TrimSpace(msg.CommandArguments()) != "subreddit" {
+		return ""
+	}
+	if err := blocklist.blockSubreddit(chatID, post.subreddit); err != nil {
+		logger.Error("Error saving blocklist", "error", err)
+	}
+	logger.Info("Subreddit blocked")
+	return "Got it, no more posts from " + post.subreddit + " here."
+}
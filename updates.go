@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/telegram-bot-api.v4"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	// Long polling timeout for Telegram updates, in seconds.
+	updatesTimeout = 60
+
+	// Time to wait before polling again after an error.
+	updatesErrorWait = 3 * time.Second
+)
+
+// botUpdate is a Telegram update plus the fields tgbotapi doesn't decode.
+type botUpdate struct {
+	tgbotapi.Update
+
+	// Forum topic of the message (zero if not in a topic).
+	threadID int
+
+	// Set on the empty update sent after a poll returning no updates, so
+	// the update loop records a heartbeat while the bot is idle.
+	tick bool
+}
+
+// rawMessage holds the message fields not supported by tgbotapi.
+type rawMessage struct {
+	MessageThreadID int  `json:"message_thread_id"`
+	IsTopicMessage  bool `json:"is_topic_message"`
+}
+
+// rawUpdate holds the update fields not supported by tgbotapi.
+type rawUpdate struct {
+	Message       *rawMessage `json:"message"`
+	EditedMessage *rawMessage `json:"edited_message"`
+}
+
+// getUpdates returns the updates from Telegram, like tgbotapi's GetUpdates,
+// including the fields tgbotapi doesn't know about.
+func getUpdates(bot *tgbotapi.BotAPI, config tgbotapi.UpdateConfig) ([]botUpdate, error) {
+	v := url.Values{}
+	if config.Offset != 0 {
+		v.Add("offset", strconv.Itoa(config.Offset))
+	}
+	if config.Limit > 0 {
+		v.Add("limit", strconv.Itoa(config.Limit))
+	}
+	if config.Timeout > 0 {
+		v.Add("timeout", strconv.Itoa(config.Timeout))
+	}
+
+	resp, err := bot.MakeRequest("getUpdates", v)
+	if err != nil {
+		return nil, err
+	}
+
+	var updates []tgbotapi.Update
+	if err := json.Unmarshal(resp.Result, &updates); err != nil {
+		return nil, fmt.Errorf("error decoding updates: %v", err)
+	}
+	var raw []rawUpdate
+	if err := json.Unmarshal(resp.Result, &raw); err != nil {
+		return nil, fmt.Errorf("error decoding updates: %v", err)
+	}
+
+	ret := make([]botUpdate, len(updates))
+	for i, update := range updates {
+		ret[i].Update = update
+		m := raw[i].Message
+		if m == nil {
+			m = raw[i].EditedMessage
+		}
+		if m != nil && m.IsTopicMessage {
+			ret[i].threadID = m.MessageThreadID
+		}
+	}
+	return ret, nil
+}
+
+// getUpdatesChan polls Telegram for updates and sends them to the returned
+// channel, like tgbotapi's GetUpdatesChan. A tick is sent after every poll
+// returning no updates.
+func getUpdatesChan(bot *tgbotapi.BotAPI, config tgbotapi.UpdateConfig) <-chan botUpdate {
+	ch := make(chan botUpdate, bot.Buffer)
+
+	go func() {
+		for {
+			updates, err := getUpdates(bot, config)
+			if err != nil {
+				slog.Warn("Failed to get updates, retrying", "wait", updatesErrorWait, "error", err)
+				time.Sleep(updatesErrorWait)
+				continue
+			}
+			if len(updates) == 0 {
+				ch <- botUpdate{tick: true}
+				continue
+			}
+
+			for _, update := range updates {
+				if update.UpdateID >= config.Offset {
+					config.Offset = update.UpdateID + 1
+					ch <- update
+				}
+			}
+		}
+	}()
+
+	return ch
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"gopkg.in/telegram-bot-api.v4"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+const (
+	// Callback data kind for the vote buttons.
+	voteCallback = "vote"
+
+	// Bounds for the vote factor applied to rule percentages (see
+	// percentage).
+	minVoteFactor = 0.5
+	maxVoteFactor = 1.5
+)
+
+// voteCount holds the votes for one subreddit (or source target).
+type voteCount struct {
+	Up   int `json:"up"`
+	Down int `json:"down"`
+}
+
+// voteStore holds the votes on the bot's posts, per rule and subreddit.
+// Changes are saved to a file immediately.
+type voteStore struct {
+	mu    sync.Mutex
+	fname string
+	rules map[string]map[string]*voteCount
+
+	// Adjust rule percentages based on votes.
+	tune bool
+}
+
+// votes holds the bot's votes. Nil disables voting.
+var votes *voteStore
+
+// loadVotes reads the votes from the state directory. A missing file yields
+// no votes. If tune is set, votes adjust the rule percentages.
+func loadVotes(tune bool) (*voteStore, error) {
+	dir, err := stateDir()
+	if err != nil {
+		return nil, err
+	}
+	v := &voteStore{
+		fname: filepath.Join(dir, votesFile),
+		rules: map[string]map[string]*voteCount{},
+		tune:  tune,
+	}
+	buf, err := ioutil.ReadFile(v.fname)
+	if os.IsNotExist(err) {
+		return v, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(buf, &v.rules); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// save writes the votes to their file. Must be called with v.mu held.
+func (v *voteStore) save() error {
+	buf, err := json.MarshalIndent(v.rules, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(v.fname), 0700); err != nil {
+		return err
+	}
+	tmp := v.fname + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, v.fname)
+}
+
+// record changes a vote on a post from rule and subreddit from prev to cur
+// (1 for up, -1 for down, 0 for no vote).
+func (v *voteStore) record(rule, subreddit string, prev, cur int) error {
+	if v == nil || prev == cur {
+		return nil
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	subs, ok := v.rules[rule]
+	if !ok {
+		subs = map[string]*voteCount{}
+		v.rules[rule] = subs
+	}
+	subreddit = strings.ToLower(subreddit)
+	c, ok := subs[subreddit]
+	if !ok {
+		c = &voteCount{}
+		subs[subreddit] = c
+	}
+
+	switch prev {
+	case 1:
+		c.Up--
+	case -1:
+		c.Down--
+	}
+	switch cur {
+	case 1:
+		c.Up++
+	case -1:
+		c.Down++
+	}
+	return v.save()
+}
+
+// percentage returns the effective percentage for rule. With tuning
+// enabled, the rule percentage is multiplied by a factor between
+// minVoteFactor (all downvotes) and maxVoteFactor (all upvotes), based on
+// the votes on all posts from the rule. Rules without votes keep their
+// percentage.
+func (v *voteStore) percentage(rule TriggerRule) int {
+	if v == nil || !v.tune {
+		return rule.percentage
+	}
+	v.mu.Lock()
+	var up, down int
+	for _, c := range v.rules[rule.name] {
+		up += c.Up
+		down += c.Down
+	}
+	v.mu.Unlock()
+
+	// Laplace smoothing keeps a few early votes from swinging the
+	// percentage too much. No votes gives a score of 0.5 (factor 1).
+	score := float64(up+1) / float64(up+down+2)
+	factor := minVoteFactor + score*(maxVoteFactor-minVoteFactor)
+
+	pct := int(float64(rule.percentage)*factor + 0.5)
+	if pct < 1 {
+		pct = 1
+	}
+	if pct > 100 {
+		pct = 100
+	}
+	return pct
+}
+
+// voteButtons returns the vote buttons for a post, with the vote counts.
+func voteButtons(up, down int) []tgbotapi.InlineKeyboardButton {
+	label := func(emoji string, n int) string {
+		if n == 0 {
+			return emoji
+		}
+		return fmt.Sprintf("%s %d", emoji, n)
+	}
+	return tgbotapi.NewInlineKeyboardRow(
+		tgbotapi.NewInlineKeyboardButtonData(label("👍", up), voteCallback+":up"),
+		tgbotapi.NewInlineKeyboardButtonData(label("👎", down), voteCallback+":down"),
+	)
+}
+
+// handleVote handles a press on one of the vote buttons. Pressing the same
+// button again withdraws the vote. Votes are ignored when voting is disabled
+// (buttons may remain on posts sent before that).
+func handleVote(bot tgbotSender, cq *tgbotapi.CallbackQuery, config botConfig, _ mediaSources) {
+	answer := func(text string) {
+		answerCallback(bot, cq, text)
+	}
+	if cq.Message == nil {
+		answer("")
+		return
+	}
+	if !config.Votes {
+		answer("Sorry, voting is disabled.")
+		return
+	}
+
+	cur := 1
+	if cq.Data == voteCallback+":down" {
+		cur = -1
+	}
+
+	chatID := cq.Message.Chat.ID
+	logger := slog.With("chat_id", chatID, "user_id", cq.From.ID)
+
+	post := sent.find(chatID, cq.Message.MessageID)
+	if post == nil {
+		answer("Sorry, voting on this post is closed.")
+		return
+	}
+
+	sent.mu.Lock()
+	prev := post.votes[cq.From.ID]
+	if prev == cur {
+		cur = 0
+	}
+	post.votes[cq.From.ID] = cur
+	var up, down int
+	for _, v := range post.votes {
+		switch v {
+		case 1:
+			up++
+		case -1:
+			down++
+		}
+	}
+	sent.mu.Unlock()
+
+	logger = logger.With("rule", post.rule, "subreddit", post.subreddit, "vote", cur)
+	if err := votes.record(post.rule, post.subreddit, prev, cur); err != nil {
+		logger.Error("Error saving votes", "error", err)
+	}
+	votesReceived.WithLabelValues(post.rule, voteName(cur)).Inc()
+	logger.Info("Vote recorded")
+
+	if kb := postKeyboard(config, up, down); kb != nil {
+		if _, err := bot.Send(tgbotapi.NewEditMessageReplyMarkup(chatID, post.messageID, *kb)); err != nil {
+			logger.Warn("Error updating vote buttons", "error", err)
+		}
+	}
+	if cur == 0 {
+		answer("Vote withdrawn.")
+		return
+	}
+	answer("Thanks for voting!")
+}
+
+// voteName returns a printable name for a vote.
+func voteName(v int) string {
+	switch v {
+	case 1:
+		return "up"
+	case -1:
+		return "down"
+	}
+	return "withdrawn"
+}